@@ -1,174 +1,2764 @@
 // Package cross defines contracts between Go programs.
+//
+// All timestamps and durations (Ts, Pts, Duration) are int64 nanoseconds, as in time.Duration.
+// Code facing C#, which conventionally uses milliseconds, should convert explicitly using FromMillis and ToMillis.
 package cross
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 	"unsafe"
 
 	"github.com/blitz-frost/io"
 )
 
 const (
-	InputNone    InputKind = 0 // needed when iterating in Unity, as C# functions return a single value
-	InputKeyDown           = 1
-	InputKeyUp             = 2
-	InputScroll            = 3 // usually mouse wheel
-	InputVector            = 4 // usually mouse or touch screen tracking
+	InputNone          InputKind = 0 // needed when iterating in Unity, as C# functions return a single value
+	InputKeyDown                 = 1
+	InputKeyUp                   = 2
+	InputScroll                  = 3  // usually mouse wheel
+	InputVector                  = 4  // usually mouse or touch screen tracking
+	InputScrollUnit              = 5  // scroll with an explicit ScrollUnit, see AppendScrollUnit
+	InputRequestFps              = 6  // client requested frame rate change, see AppendRequestFps
+	InputWebcamFps               = 7  // engine imposed webcam frame rate cap, see AppendWebcamFps
+	InputContextMenu             = 8  // right click or long press, at a position
+	InputFocusLost               = 9  // no payload; the engine should release all held keys
+	InputVectorTo                = 10 // vector tagged with a target subsystem, see AppendVectorTo
+	InputKeyDownTo               = 11 // see AppendKeyDownTo
+	InputKeyUpTo                 = 12 // see AppendKeyUpTo
+	InputScrollUnitTo            = 13 // see AppendScrollUnitTo
+	InputContextMenuTo           = 14 // see AppendContextMenuTo
 )
 
 const (
-	PacketVideo PacketKind = 0
-	PacketAudio            = 1
-	PacketInput            = 2
-	PacketSync             = 3
+	PacketVideo             PacketKind = 0
+	PacketAudio                        = 1
+	PacketInput                        = 2
+	PacketSync                         = 3
+	PacketMeta                         = 4  // out of band application metadata, see MetaPayload
+	PacketVideoLossless                = 5  // on demand VideoPayload that bypasses the lossy pipeline, suitable for screenshots
+	PacketResumeRequest                = 6  // client to engine, see ResumePayload
+	PacketResumeAccept                 = 7  // engine to client, see ResumePayload
+	PacketResumeReject                 = 8  // engine to client, no payload; the client must perform a fresh handshake
+	PacketFEC                          = 9  // XOR parity over a group of packets, see MakeFEC
+	PacketOverlay                      = 10 // see OverlayPayload
+	PacketSyncAnchor                   = 11 // see SyncAnchorPayload
+	PacketVideoDiff                    = 12 // see VideoDiff
+	PacketAudioBatch                   = 13 // see AudioBatch
+	PacketPause                        = 14 // engine to client, no payload; no media follows until PacketResume
+	PacketResume                       = 15 // engine to client, no payload; ends a pause, unrelated to session resumption
+	PacketDecoderReset                 = 16 // client to engine, no payload; requests a clean GOP after unrecoverable corruption
+	PacketDecoderResetPoint            = 17 // engine to client, see DecoderResetPayload
+	PacketVideoRect                    = 18 // see VideoRectPayload
+	PacketReconfigure                  = 19 // engine to client, a Primary encoded by MarshalBinary; applied at the next keyframe
 )
 
+// PacketHeaderSize is the size of the Id, Kind, Size and TTL fields preceding a packet's payload.
+const PacketHeaderSize = 18
+
+// DefaultTTL is the number of relay hops a new packet may take.
+const DefaultTTL = 16
+
+// ProtocolVersion holds the major version in the high nibble and the minor version in the low nibble.
+const ProtocolVersion uint8 = 0x10
+
+const (
+	PixelRGBA PixelFormat = 0 // 8 bits per channel, uncompressed, so always lossless
+	PixelNV12             = 1 // full resolution Y plane, followed by an interleaved UV plane at half resolution
+)
+
+const (
+	TierSD  QualityTier = 0
+	TierHD              = 1
+	TierFHD             = 2
+	Tier4K              = 3
+)
+
+// Quality tier thresholds. A Primary reaches a tier when its render area is at least the tier's pixel count.
+const (
+	TierHDPixels  = 1280 * 720
+	TierFHDPixels = 1920 * 1080
+	Tier4KPixels  = 3840 * 2160
+	TierMinFps    = 30 // tiers above SD drop one level below this frame rate
+)
+
+const (
+	VideoKeyframe         VideoFlags = 1 // the frame doesn't depend on previous frames
+	VideoResolutionChange            = 2 // first frame at new dimensions; the client must reinitialize its decoder and buffers; implies VideoKeyframe
+)
+
+// Bounds of a negotiated Primary.InputRate.
+const (
+	InputRateMin = 10
+	InputRateMax = 1000
+)
+
+const (
+	ScrollPixel ScrollUnit = 0
+	ScrollLine             = 1
+	ScrollPage             = 2
+)
+
+const (
+	audioBatchHeaderSize = 16
+	audioHeaderSize      = 24
+	overlayHeaderSize    = 24
+	primaryBinarySize    = 37
+	videoHeaderSize      = 40
+	videoRectHeaderSize  = 32
+)
+
+// ErrAudioDownmix is returned by AudioPayload.Downmix for unsupported channel conversions.
+var ErrAudioDownmix = errors.New("unsupported channel conversion")
+
+// ErrAudioFormat is returned when combining audio payloads of different sample rates or channel counts.
+var ErrAudioFormat = errors.New("mismatched audio format")
+
+// ErrIncompatibleVersion should be returned by handshakes that fail CompatibleVersion.
+var ErrIncompatibleVersion = errors.New("incompatible protocol version")
+
+// ErrInputMalformed is returned when an InputPayload contains an unknown or truncated event.
+var ErrInputMalformed = errors.New("malformed input payload")
+
+// ErrInputTooLarge is returned by ParseInputPayload for payloads exceeding MaxInputPayloadSize.
+var ErrInputTooLarge = errors.New("input payload too large")
+
+// ErrLimitExceeded is wrapped by Primary.Acceptable, with details of the violated limit.
+var ErrLimitExceeded = errors.New("engine limit exceeded")
+
+// ErrNoKeyframe is returned by Framebuffer.ApplyRect before any keyframe was applied.
+var ErrNoKeyframe = errors.New("no keyframe")
+
+// ErrPacketKind is returned by As when a packet's kind doesn't match the requested payload type.
+var ErrPacketKind = errors.New("unexpected packet kind")
+
+// ErrPacketSize is returned by ParsePacket when the header's payload size doesn't fit the received data.
+var ErrPacketSize = errors.New("invalid packet size")
+
+// ErrPixelFormat is returned when a VideoPayload has an unknown or unsupported PixelFormat.
+var ErrPixelFormat = errors.New("unsupported pixel format")
+
+// ErrPayloadTruncated is returned by As when a payload is shorter than its header, and by decoders when data doesn't match the header describing it.
+var ErrPayloadTruncated = errors.New("truncated payload")
+
+// ErrRectBounds is returned by Framebuffer.ApplyRect for rectangles not fully within the frame.
+var ErrRectBounds = errors.New("rectangle out of bounds")
+
+// ErrVideoDiffMalformed is returned by VideoApplyDiff for diffs that don't fit the previous frame.
+var ErrVideoDiffMalformed = errors.New("malformed video diff")
+
+// DefaultClock is used by Now, and through it by all timestamping helpers of this package. Tests may replace it to control time.
+var DefaultClock Clock = monotonicClock{}
+
+// DefaultEncryptionPolicy sends live video and audio, along with their derived kinds, in the clear.
+// All other kinds are encrypted, including PacketFEC, as parity data may be derived from sensitive packets.
+var DefaultEncryptionPolicy = EncryptionPolicy{
+	PacketVideo:      false,
+	PacketAudio:      false,
+	PacketInput:      true, // redundant, but documents the motivating case
+	PacketVideoDiff:  false,
+	PacketAudioBatch: false,
+	PacketVideoRect:  false,
+}
+
+// MaxInputPayloadSize limits the size of received input payloads, including the timestamp header.
+// The default comfortably fits large coalesced batches.
+var MaxInputPayloadSize = 64 * 1024
+
+// MinLatencyFloor is the minimal encode and network allowance added by Primary.MinLatency.
+var MinLatencyFloor = 5 * time.Millisecond
+
+// epoch is the time reference of monotonicClock.
+var epoch = time.Now()
+
+// payloadHeaderSizes holds the minimum payload size of each packet kind with a Payload type, used by As.
+var payloadHeaderSizes = map[PacketKind]int{
+	PacketVideo:             videoHeaderSize,
+	PacketAudio:             audioHeaderSize,
+	PacketInput:             8,
+	PacketMeta:              1,
+	PacketVideoLossless:     videoHeaderSize,
+	PacketOverlay:           overlayHeaderSize,
+	PacketSyncAnchor:        16,
+	PacketAudioBatch:        audioBatchHeaderSize,
+	PacketDecoderResetPoint: 8,
+	PacketVideoRect:         videoRectHeaderSize,
+}
+
+// payloadValidators holds additional checks used by As, for kinds whose header describes variable length contents.
+var payloadValidators = map[PacketKind]func([]byte) error{
+	PacketVideo:         validateWith(ParseVideoPayload),
+	PacketInput:         validateWith(ParseInputPayload),
+	PacketMeta:          validateWith(ParseMetaPayload),
+	PacketVideoLossless: validateWith(ParseVideoPayload),
+	PacketOverlay:       validateWith(ParseOverlayPayload),
+	PacketAudioBatch:    validateWith(ParseAudioBatch),
+	PacketVideoRect:     validateWith(ParseVideoRectPayload),
+}
+
+// AVSyncMonitor tracks the offset between video and audio presented together, flagging lip-sync drift only once it is sustained.
+// The offset is smoothed like TCP's SRTT, so transient jitter doesn't move it much, and must then stay beyond the threshold for a number of consecutive observations.
+type AVSyncMonitor struct {
+	threshold time.Duration
+	hold      int
+
+	mux    sync.Mutex
+	offset time.Duration
+	primed bool // at least one observation
+	beyond int  // consecutive observations with the smoothed offset beyond threshold
+}
+
+// NewAVSyncMonitor flags drift once the smoothed offset stays beyond threshold for hold consecutive observations.
+// hold is raised to at least 1.
+func NewAVSyncMonitor(threshold time.Duration, hold int) *AVSyncMonitor {
+	if hold < 1 {
+		hold = 1
+	}
+	return &AVSyncMonitor{
+		threshold: threshold,
+		hold:      hold,
+	}
+}
+
+// Drift returns the smoothed offset, positive when video is ahead of audio, and whether it amounts to sustained drift.
+// The client can then resample audio, or drop or repeat video frames, to regain sync.
+func (x *AVSyncMonitor) Drift() (time.Duration, bool) {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	return x.offset, x.primed && x.beyond >= x.hold
+}
+
+// Observe records the Pts of the video frame and audio sample presented at the same moment.
+// Both must share the same timeline.
+func (x *AVSyncMonitor) Observe(videoPts, audioPts time.Duration) {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	offset := videoPts - audioPts
+	if !x.primed {
+		x.offset = offset
+		x.primed = true
+	} else {
+		x.offset += (offset - x.offset) / 8
+	}
+
+	if x.offset > x.threshold || x.offset < -x.threshold {
+		x.beyond++
+	} else {
+		x.beyond = 0
+	}
+}
+
+// As returns the payload of x as a T, without copying.
+// It checks that the packet kind matches T, that the payload is large enough to hold T's header, and that the header is consistent for kinds registered in payloadValidators.
+// VideoPayload also matches PacketVideoLossless packets.
+func As[T interface {
+	Payload
+	~[]byte
+}](x Packet) (T, error) {
+	var zero T
+	kind := x.Kind()
+	if want := zero.Kind(); kind != want && !(want == PacketVideo && kind == PacketVideoLossless) {
+		return zero, ErrPacketKind
+	}
+
+	payload := x.Payload()
+	if len(payload) < payloadHeaderSizes[kind] {
+		return zero, ErrPayloadTruncated
+	}
+	if validate, ok := payloadValidators[kind]; ok {
+		if err := validate(payload); err != nil {
+			return zero, err
+		}
+	}
+	return T(payload), nil
+}
+
+// AudioBatch holds a series of small audio chunks of equal sample count, with less overhead than separate AudioPayloads.
+// The header holds the base Pts and the chunk sample count (uint32), padded to 16 bytes.
+// Each chunk consists of its duration (uint32 nanoseconds) followed by its interleaved 16 bit PCM samples.
+// The Pts of a chunk is the base Pts plus the durations of all preceding chunks.
+type AudioBatch []byte
+
+func MakeAudioBatch(pts time.Duration, chunkSamples int) AudioBatch {
+	x := make(AudioBatch, audioBatchHeaderSize)
+	x.PtsSet(pts)
+	n := uint32(chunkSamples)
+	b := *(*[4]byte)(unsafe.Pointer(&n))
+	copy(x[8:], b[:])
+	return x
+}
+
+// ParseAudioBatch validates a received batch, without copying it.
+func ParseAudioBatch(b []byte) (AudioBatch, error) {
+	if len(b) < audioBatchHeaderSize {
+		return nil, ErrPayloadTruncated
+	}
+
+	x := AudioBatch(b)
+	chunk := 4 + 2*uint64(x.ChunkSamples())
+	if uint64(len(b)-audioBatchHeaderSize)%chunk != 0 {
+		return nil, ErrPayloadTruncated
+	}
+	return x, nil
+}
+
+// Append adds a chunk. Panics if samples doesn't match the batch's chunk sample count.
+func (x AudioBatch) Append(duration time.Duration, samples []int16) AudioBatch {
+	if len(samples) != x.ChunkSamples() {
+		panic("audio chunk size mismatch")
+	}
+
+	d := uint32(duration)
+	b := *(*[4]byte)(unsafe.Pointer(&d))
+	x = append(x, b[:]...)
+	for i := range samples {
+		b := *(*[2]byte)(unsafe.Pointer(&samples[i]))
+		x = append(x, b[0], b[1])
+	}
+	return x
+}
+
+func (x AudioBatch) Bytes() []byte {
+	return x
+}
+
+func (x AudioBatch) ChunkSamples() int {
+	return int(*(*uint32)(unsafe.Pointer(&x[8])))
+}
+
+// Chunks returns an iterator over the chunks of x.
+func (x AudioBatch) Chunks() *AudioBatchIter {
+	return &AudioBatchIter{
+		b:   x[audioBatchHeaderSize:],
+		n:   4 + 2*x.ChunkSamples(),
+		pts: x.Pts(),
+	}
+}
+
+func (x AudioBatch) Kind() PacketKind {
+	return PacketAudioBatch
+}
+
+func (x AudioBatch) Pts() time.Duration {
+	return *(*time.Duration)(unsafe.Pointer(&x[0])) // int64
+}
+
+func (x AudioBatch) PtsSet(t time.Duration) {
+	b := *(*[8]byte)(unsafe.Pointer(&t))
+	copy(x, b[:])
+}
+
+// Ts is the same as Pts.
+func (x AudioBatch) Ts() time.Duration {
+	return x.Pts()
+}
+
+type AudioBatchIter struct {
+	b   []byte
+	n   int // chunk size in bytes
+	pts time.Duration
+}
+
+// Next returns the Pts and samples of the next chunk, without copying.
+// Returns false when there are no more complete chunks.
+func (x *AudioBatchIter) Next() (time.Duration, []int16, bool) {
+	if len(x.b) < x.n {
+		return 0, nil, false
+	}
+
+	chunk := x.b[:x.n]
+	x.b = x.b[x.n:]
+
+	pts := x.pts
+	x.pts += time.Duration(*(*uint32)(unsafe.Pointer(&chunk[0])))
+
+	var samples []int16
+	if data := chunk[4:]; len(data) > 0 {
+		samples = unsafe.Slice((*int16)(unsafe.Pointer(&data[0])), len(data)/2)
+	}
+	return pts, samples, true
+}
+
+// AudioPayload holds interleaved 16 bit PCM samples. The header is laid out as:
+//
+//	0  Pts
+//	8  Duration
+//	16 sample rate (uint32)
+//	20 channel count
+//	21 reserved, up to the sample data at offset 24
+//
+// A payload with no sample data is a silence marker: the receiver should fill its Duration with silence or comfort noise.
+type AudioPayload []byte
+
+// MakeAudioPayload returns a payload holding the given number of samples per channel, with its Duration computed from the sample rate.
+func MakeAudioPayload(sampleRate, channels, frames int) AudioPayload {
+	x := make(AudioPayload, audioHeaderSize+2*channels*frames)
+	x.SampleRateSet(sampleRate)
+	x.ChannelsSet(channels)
+	if sampleRate > 0 {
+		x.DurationSet(time.Duration(frames) * time.Second / time.Duration(sampleRate))
+	}
+	return x
+}
+
+func (x AudioPayload) Bytes() []byte {
+	return x
+}
+
+func (x AudioPayload) Channels() int {
+	return int(x[20])
+}
+
+func (x AudioPayload) ChannelsSet(n int) {
+	x[20] = byte(n)
+}
+
+func (x AudioPayload) Data() []byte {
+	return x[audioHeaderSize:]
+}
+
+// Downmix returns a copy of x with fewer channels, using ITU-R BS.775 coefficients. The LFE channel is discarded.
+// Supported conversions are from stereo to mono and from 5.1 (FL, FR, FC, LFE, SL, SR) to stereo or mono.
+// Converting to the same channel count returns x unchanged.
+func (x AudioPayload) Downmix(targetChannels uint8) (AudioPayload, error) {
+	channels := x.Channels()
+	target := int(targetChannels)
+	if target == channels {
+		return x, nil
+	}
+
+	var mix func(in []int16) (l, r float64)
+	switch {
+	case channels == 2 && target == 1:
+		mix = func(in []int16) (float64, float64) {
+			return float64(in[0]), float64(in[1])
+		}
+	case channels == 6 && (target == 1 || target == 2):
+		const k = 0.7071
+		mix = func(in []int16) (float64, float64) {
+			c := k * float64(in[2])
+			return float64(in[0]) + c + k*float64(in[4]), float64(in[1]) + c + k*float64(in[5])
+		}
+	default:
+		return nil, ErrAudioDownmix
+	}
+
+	samples := x.Samples()
+	frames := len(samples) / channels
+
+	y := make(AudioPayload, audioHeaderSize+2*target*frames)
+	copy(y, x[:audioHeaderSize])
+	y.ChannelsSet(target)
+
+	out := y.Samples()
+	for i := 0; i < frames; i++ {
+		l, r := mix(samples[i*channels:])
+		if target == 1 {
+			out[i] = saturateInt16((l + r) / 2)
+		} else {
+			out[2*i], out[2*i+1] = saturateInt16(l), saturateInt16(r)
+		}
+	}
+	return y, nil
+}
+
+func (x AudioPayload) Duration() time.Duration {
+	return *(*time.Duration)(unsafe.Pointer(&x[8]))
+}
+
+func (x AudioPayload) DurationSet(t time.Duration) {
+	b := *(*[8]byte)(unsafe.Pointer(&t))
+	copy(x[8:], b[:])
+}
+
+// IsGap reports whether x is a silence marker.
+func (x AudioPayload) IsGap() bool {
+	return len(x) == audioHeaderSize
+}
+
+// IsSilent reports whether all sample amplitudes are within threshold.
+// Senders can replace silent payloads with the result of Silence.
+func (x AudioPayload) IsSilent(threshold int16) bool {
+	for _, v := range x.Samples() {
+		if v > threshold || v < -threshold {
+			return false
+		}
+	}
+	return true
+}
+
+func (x AudioPayload) Kind() PacketKind {
+	return PacketAudio
+}
+
+func (x AudioPayload) Pts() time.Duration {
+	return *(*time.Duration)(unsafe.Pointer(&x[0])) // int64
+}
+
+func (x AudioPayload) PtsSet(t time.Duration) {
+	b := *(*[8]byte)(unsafe.Pointer(&t))
+	copy(x, b[:])
+}
+
+func (x AudioPayload) SampleRate() int {
+	return int(*(*uint32)(unsafe.Pointer(&x[16])))
+}
+
+func (x AudioPayload) SampleRateSet(rate int) {
+	r := uint32(rate)
+	b := *(*[4]byte)(unsafe.Pointer(&r))
+	copy(x[16:], b[:])
+}
+
+// Samples returns the sample data as a slice, without copying.
+func (x AudioPayload) Samples() []int16 {
+	data := x.Data()
+	if len(data) < 2 {
+		return nil
+	}
+	return unsafe.Slice((*int16)(unsafe.Pointer(&data[0])), len(data)/2)
+}
+
+// Silence returns the silence marker equivalent of x, keeping its timing. Does not reallocate.
+func (x AudioPayload) Silence() AudioPayload {
+	return x[:audioHeaderSize]
+}
+
+// Ts is the same as Pts.
+func (x AudioPayload) Ts() time.Duration {
+	return x.Pts()
+}
+
+// BandwidthByKind measures the byte rate of each client, broken down by packet kind, over a sliding window.
+type BandwidthByKind struct {
+	window time.Duration
+
+	mux     sync.Mutex
+	samples map[uint64][]bandwidthSample
+}
+
+type bandwidthSample struct {
+	t    time.Duration
+	kind PacketKind
+	n    int
+}
+
+func NewBandwidthByKind(window time.Duration) *BandwidthByKind {
+	return &BandwidthByKind{
+		window:  window,
+		samples: make(map[uint64][]bandwidthSample),
+	}
+}
+
+// Observe must be called with every sent or received packet.
+func (x *BandwidthByKind) Observe(p Packet) {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	now := Now()
+	id := p.Id()
+	x.samples[id] = append(x.prune(id, now), bandwidthSample{now, p.Kind(), len(p)})
+}
+
+// Rates returns the bytes per second of each packet kind seen for the given client during the window.
+func (x *BandwidthByKind) Rates(id uint64) map[PacketKind]float64 {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	samples := x.prune(id, Now())
+	if len(samples) == 0 {
+		delete(x.samples, id)
+		return nil
+	}
+
+	o := make(map[PacketKind]float64)
+	for _, sample := range samples {
+		o[sample.kind] += float64(sample.n)
+	}
+	for kind := range o {
+		o[kind] /= x.window.Seconds()
+	}
+	return o
+}
+
+// Remove discards all data of a client.
+func (x *BandwidthByKind) Remove(id uint64) {
+	x.mux.Lock()
+	delete(x.samples, id)
+	x.mux.Unlock()
+}
+
+// prune drops samples older than the window and returns the remaining ones.
+func (x *BandwidthByKind) prune(id uint64, now time.Duration) []bandwidthSample {
+	samples := x.samples[id]
+	i := 0
+	for i < len(samples) && samples[i].t <= now-x.window {
+		i++
+	}
+	samples = samples[i:]
+	x.samples[id] = samples
+	return samples
+}
+
+// BatchWriter accumulates packets and writes them in a single call, once either a byte threshold or a maximum delay is reached.
+// Packets must not be modified after being added.
+type BatchWriter struct {
+	w        io.Writer
+	maxBytes int
+	maxDelay time.Duration
+
+	mux     sync.Mutex
+	packets []Packet
+	n       int
+	timer   *time.Timer
+	gen     uint64 // incremented with each new timer, so callbacks of stopped timers can be told apart
+	err     error  // error of a delayed flush, returned by the next call
+}
+
+func NewBatchWriter(w io.Writer, maxBytes int, maxDelay time.Duration) *BatchWriter {
+	return &BatchWriter{
+		w:        w,
+		maxBytes: maxBytes,
+		maxDelay: maxDelay,
+	}
+}
+
+// Add always queues p. The returned error may come from an earlier delayed flush, rather than from this call.
+func (x *BatchWriter) Add(p Packet) error {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	err := x.err
+	x.err = nil
+
+	x.packets = append(x.packets, p)
+	x.n += len(p)
+	if x.n >= x.maxBytes {
+		if flushErr := x.flush(); err == nil {
+			err = flushErr
+		}
+		return err
+	}
+
+	if x.timer == nil {
+		x.gen++
+		gen := x.gen
+		x.timer = time.AfterFunc(x.maxDelay, func() { x.flushDelayed(gen) })
+	}
+	return err
+}
+
+// Flush always writes the queued packets. Like Add, it may return the error of an earlier delayed flush instead.
+func (x *BatchWriter) Flush() error {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	err := x.err
+	x.err = nil
+
+	if flushErr := x.flush(); err == nil {
+		err = flushErr
+	}
+	return err
+}
+
+func (x *BatchWriter) flush() error {
+	if x.timer != nil {
+		x.timer.Stop()
+		x.timer = nil
+	}
+	if len(x.packets) == 0 {
+		return nil
+	}
+
+	err := WritePackets(x.w, x.packets...)
+	for i := range x.packets {
+		x.packets[i] = nil
+	}
+	x.packets = x.packets[:0]
+	x.n = 0
+	return err
+}
+
+// flushDelayed is called by the timer of generation gen.
+func (x *BatchWriter) flushDelayed(gen uint64) {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	if x.timer == nil || gen != x.gen {
+		return // stopped while this call was waiting for the lock
+	}
+	if err := x.flush(); err != nil && x.err == nil {
+		x.err = err
+	}
+}
+
 type Client struct {
 	Id    func() (Primary, error) // should probably separate identification from video settings
 	Start func() error
 }
 
-type Engine struct {
-	PrimaryAdd      func(Primary) error
-	PrimaryRemove   func(uint64) error
-	SecondaryAdd    func(Secondary) error
-	SecondaryRemove func(uint64) error
-	Start           func(uint64) error
-	Stop            func(uint64) error
+// ClientDemuxer splits a merged packet stream into a channel per client Id, for relays serving several clients over one connection.
+// A channel is created on the first packet of its Id, and closed once no packet arrived within the idle timeout.
+// A later packet with the same Id starts a new channel.
+type ClientDemuxer struct {
+	timeout  time.Duration
+	buffer   int
+	onClient func(id uint64, packets <-chan Packet)
+
+	mux     sync.Mutex
+	clients map[uint64]*demuxedClient
+}
+
+// NewClientDemuxer returns a demuxer with channels of the given buffer size.
+// onClient is called with each new channel. It must not block or call back into the demuxer.
+func NewClientDemuxer(timeout time.Duration, buffer int, onClient func(id uint64, packets <-chan Packet)) *ClientDemuxer {
+	return &ClientDemuxer{
+		timeout:  timeout,
+		buffer:   buffer,
+		onClient: onClient,
+		clients:  make(map[uint64]*demuxedClient),
+	}
+}
+
+// Close closes all open channels, once pending Feed calls return. Feed must not be called afterwards.
+func (x *ClientDemuxer) Close() {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	for id, c := range x.clients {
+		c.timer.Stop()
+		x.remove(id, c)
+	}
+}
+
+// Feed routes p to the channel of its Id.
+// If the channel is full, droppable packets are dropped, returning false, rather than stalling the other clients.
+// Other kinds block until the channel has room, as they must never be dropped.
+func (x *ClientDemuxer) Feed(p Packet) bool {
+	id := p.Id()
+
+	x.mux.Lock()
+	c, ok := x.clients[id]
+	if !ok {
+		c = &demuxedClient{ch: make(chan Packet, x.buffer)}
+		c.timer = time.AfterFunc(x.timeout, func() { x.expire(id, c) })
+		x.clients[id] = c
+		x.onClient(id, c.ch)
+	}
+	c.last = time.Now()
+	c.sending++
+	x.mux.Unlock()
+
+	sent := true
+	if p.Kind().Droppable() {
+		select {
+		case c.ch <- p:
+		default:
+			sent = false
+		}
+	} else {
+		c.ch <- p
+	}
+
+	x.mux.Lock()
+	c.sending--
+	if c.closing && c.sending == 0 {
+		close(c.ch)
+	}
+	x.mux.Unlock()
+	return sent
+}
+
+// expire closes the channel of c if it has been idle for the full timeout, or rearms its timer otherwise.
+// Idle time is measured on the same clock as the timer, not through Now, which tests may freeze.
+func (x *ClientDemuxer) expire(id uint64, c *demuxedClient) {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	if x.clients[id] != c {
+		return // closed
+	}
+	if idle := time.Since(c.last); idle < x.timeout {
+		c.timer.Reset(x.timeout - idle)
+		return
+	}
+	x.remove(id, c)
+}
+
+// remove unregisters c, closing its channel once no Feed call is sending to it.
+func (x *ClientDemuxer) remove(id uint64, c *demuxedClient) {
+	delete(x.clients, id)
+	c.closing = true
+	if c.sending == 0 {
+		close(c.ch)
+	}
+}
+
+type demuxedClient struct {
+	ch      chan Packet
+	timer   *time.Timer
+	last    time.Time
+	sending int  // Feed calls sending to ch outside the lock
+	closing bool // ch must be closed once sending drops to 0
+}
+
+// Clock is a source of timestamps, relative to a fixed epoch.
+type Clock interface {
+	Now() time.Duration
+}
+
+// CoalesceAudio concatenates consecutive frames into payloads of at least the target duration, to reduce per packet overhead.
+// The last output payload may be shorter. Each output keeps the Pts of its first frame, with its Duration computed from its sample count.
+// Silence markers are passed through as is, ending the current output.
+func CoalesceAudio(frames []AudioPayload, target time.Duration) ([]AudioPayload, error) {
+	if len(frames) == 0 {
+		return nil, nil
+	}
+
+	rate, channels := frames[0].SampleRate(), frames[0].Channels()
+	for _, f := range frames[1:] {
+		if f.SampleRate() != rate || f.Channels() != channels {
+			return nil, ErrAudioFormat
+		}
+	}
+
+	var o []AudioPayload
+	var cur AudioPayload
+	flush := func() {
+		if cur == nil {
+			return
+		}
+		if rate > 0 && channels > 0 {
+			n := len(cur.Data()) / (2 * channels)
+			cur.DurationSet(time.Duration(n) * time.Second / time.Duration(rate))
+		}
+		o = append(o, cur)
+		cur = nil
+	}
+
+	var duration time.Duration
+	for _, f := range frames {
+		if f.IsGap() {
+			flush()
+			o = append(o, f)
+			continue
+		}
+
+		if cur == nil {
+			cur = append(AudioPayload{}, f...)
+			duration = f.Duration()
+		} else {
+			cur = append(cur, f.Data()...)
+			duration += f.Duration()
+		}
+		if duration >= target {
+			flush()
+		}
+	}
+	flush()
+
+	return o, nil
+}
+
+// CompatibleVersion reports whether a peer using the remote protocol version can be talked to.
+// Versions sharing the same major version are compatible; minor versions only add backwards compatible features.
+func CompatibleVersion(remote uint8) bool {
+	return remote>>4 == ProtocolVersion>>4
+}
+
+// DecoderResetPayload holds the Pts of the keyframe from which decoding restarts.
+// The engine sends it in reply to a PacketDecoderReset, or on its own after resetting its encoder, and then emits a fresh keyframe at that Pts.
+// On receipt, the client discards its decoder state and drops all video until that keyframe.
+type DecoderResetPayload []byte
+
+func MakeDecoderResetPayload(pts time.Duration) DecoderResetPayload {
+	x := make(DecoderResetPayload, 8)
+	x.PtsSet(pts)
+	return x
+}
+
+func (x DecoderResetPayload) Bytes() []byte {
+	return x
+}
+
+func (x DecoderResetPayload) Kind() PacketKind {
+	return PacketDecoderResetPoint
+}
+
+func (x DecoderResetPayload) Pts() time.Duration {
+	return *(*time.Duration)(unsafe.Pointer(&x[0])) // int64
+}
+
+func (x DecoderResetPayload) PtsSet(t time.Duration) {
+	b := *(*[8]byte)(unsafe.Pointer(&t))
+	copy(x, b[:])
+}
+
+// Ts is the same as Pts.
+func (x DecoderResetPayload) Ts() time.Duration {
+	return x.Pts()
+}
+
+// EncryptionPolicy lets a transport send bulk media in the clear, while encrypting kinds that carry sensitive data, such as PacketInput with typed passwords.
+// Kinds map to whether they are encrypted. Kinds missing from the policy are encrypted, so that new kinds are protected until explicitly cleared.
+type EncryptionPolicy map[PacketKind]bool
+
+// Encrypts reports whether packets of the given kind must be encrypted.
+func (x EncryptionPolicy) Encrypts(kind PacketKind) bool {
+	on, ok := x[kind]
+	return on || !ok
+}
+
+type Engine struct {
+	PrimaryAdd      func(Primary) error
+	PrimaryRemove   func(uint64) error
+	SecondaryAdd    func(Secondary) error
+	SecondaryRemove func(uint64) error
+	Start           func(uint64) error
+	Stop            func(uint64) error
+}
+
+// Supports reports whether the named method is implemented, meaning the field is non-nil.
+// Returns false for unknown names, so callers can probe for methods introduced by later versions.
+func (x Engine) Supports(method string) bool {
+	v := reflect.ValueOf(x).FieldByName(method)
+	return v.IsValid() && v.Kind() == reflect.Func && !v.IsNil()
+}
+
+// EngineLimits declares what an engine deployment can serve, see Primary.Acceptable.
+// Zero fields are unlimited.
+type EngineLimits struct {
+	MaxRenderWidth  int32
+	MaxRenderHeight int32
+	MaxWebcamWidth  int32
+	MaxWebcamHeight int32
+	MaxFps          float32
+	InputKinds      uint32 // see InputMask
+}
+
+// MakeFEC returns a parity packet over group, from which any single missing packet can be recovered using RecoverFEC.
+// The parity packet takes its Id from the first packet in the group.
+//
+// Its payload holds the group size and the XOR of all packet lengths, as uint64, followed by the XOR of all packets.
+// The TTL byte is excluded, as relays modify it; a recovered packet takes the TTL of the parity packet instead.
+func MakeFEC(group []Packet) Packet {
+	var n int
+	for _, p := range group {
+		if len(p) > n {
+			n = len(p)
+		}
+	}
+
+	x := MakePacket(16 + n)
+	x.KindSet(PacketFEC)
+	if len(group) > 0 {
+		x.IdSet(group[0].Id())
+	}
+
+	payload := x.Payload()
+	count := uint64(len(group))
+	b := *(*[8]byte)(unsafe.Pointer(&count))
+	copy(payload, b[:])
+
+	var length uint64
+	for _, p := range group {
+		length ^= uint64(len(p))
+		xorBytes(payload[16:], p)
+	}
+	if len(payload) > 16+17 {
+		payload[16+17] = 0 // TTL
+	}
+	b = *(*[8]byte)(unsafe.Pointer(&length))
+	copy(payload[8:], b[:])
+
+	return x
+}
+
+// RecoverFEC reconstructs the single missing packet of a group, given the other packets and the group's parity packet.
+// Returns false if not exactly one packet is missing, or if the packets don't fit the parity packet, as would be the case for malformed input.
+func RecoverFEC(received []Packet, parity Packet) (Packet, bool) {
+	if len(parity) < PacketHeaderSize+16 || parity.Kind() != PacketFEC {
+		return nil, false
+	}
+
+	payload := parity.Payload()
+	count := *(*uint64)(unsafe.Pointer(&payload[0]))
+	if uint64(len(received))+1 != count {
+		return nil, false
+	}
+
+	x := make(Packet, len(payload)-16)
+	copy(x, payload[16:])
+
+	length := *(*uint64)(unsafe.Pointer(&payload[8]))
+	for _, p := range received {
+		if len(p) > len(x) {
+			return nil, false
+		}
+		length ^= uint64(len(p))
+		xorBytes(x, p)
+	}
+	if length > uint64(len(x)) {
+		return nil, false
+	}
+	x = x[:length]
+	if len(x) >= PacketHeaderSize {
+		x.TTLSet(parity.TTL())
+	}
+	return x, true
+}
+
+// xorBytes XORs src into dst. src must not be longer than dst.
+func xorBytes(dst, src []byte) {
+	for i, v := range src {
+		dst[i] ^= v
+	}
+}
+
+// FairnessMonitor compares round trip times across clients, to detect clients with systematically worse latency.
+// Each client's RTT is smoothed like TCP's SRTT, so single samples don't make it an outlier.
+type FairnessMonitor struct {
+	mux sync.Mutex
+	rtt map[uint64]time.Duration
+}
+
+func NewFairnessMonitor() *FairnessMonitor {
+	return &FairnessMonitor{
+		rtt: make(map[uint64]time.Duration),
+	}
+}
+
+// Observe records an RTT sample of a client.
+func (x *FairnessMonitor) Observe(id uint64, rtt time.Duration) {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	if old, ok := x.rtt[id]; ok {
+		rtt = old + (rtt-old)/8
+	}
+	x.rtt[id] = rtt
+}
+
+// Outliers returns, in ascending order, the clients whose smoothed RTT exceeds the mean by more than k standard deviations.
+func (x *FairnessMonitor) Outliers(k float64) []uint64 {
+	mean, dev := x.Spread()
+
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	var o []uint64
+	threshold := mean + time.Duration(k*float64(dev))
+	for id, rtt := range x.rtt {
+		if rtt > threshold {
+			o = append(o, id)
+		}
+	}
+	sort.Slice(o, func(i, j int) bool { return o[i] < o[j] })
+	return o
+}
+
+func (x *FairnessMonitor) Remove(id uint64) {
+	x.mux.Lock()
+	delete(x.rtt, id)
+	x.mux.Unlock()
+}
+
+// Spread returns the mean and standard deviation of the smoothed RTTs of all clients.
+func (x *FairnessMonitor) Spread() (mean, dev time.Duration) {
+	x.mux.Lock()
+	defer x.mux.Unlock()
+
+	if len(x.rtt) == 0 {
+		return 0, 0
+	}
+
+	var sum float64
+	for _, rtt := range x.rtt {
+		sum += float64(rtt)
+	}
+	m := sum / float64(len(x.rtt))
+
+	var variance float64
+	for _, rtt := range x.rtt {
+		d := float64(rtt) - m
+		variance += d * d
+	}
+	variance /= float64(len(x.rtt))
+
+	return time.Duration(m), time.Duration(math.Sqrt(variance))
+}
+
+// FlipY converts a vertical coordinate between top-left and bottom-left origins, within a surface of the given height.
+// Out of range coordinates are clamped.
+func FlipY(y, height uint16) uint16 {
+	if y >= height {
+		return 0
+	}
+	return height - 1 - y
+}
+
+// Framebuffer maintains the current full frame of a stream made of keyframes followed by VideoRectPayload updates.
+type Framebuffer struct {
+	cur VideoPayload
+}
+
+// ApplyKeyframe replaces the current frame with a copy of v.
+// Returns ErrPayloadTruncated, keeping the current frame, if the pixel data of v doesn't match the size, area and format in its header.
+func (x *Framebuffer) ApplyKeyframe(v VideoPayload) error {
+	if _, err := ParseVideoPayload(v); err != nil {
+		return err
+	}
+
+	if len(x.cur) != len(v) {
+		x.cur = make(VideoPayload, len(v))
+	}
+	copy(x.cur, v)
+	return nil
+}
+
+// ApplyRect copies the pixels of r into the current frame, which also takes over its Pts.
+// Only RGBA frames are supported.
+func (x *Framebuffer) ApplyRect(r VideoRectPayload) error {
+	if x.cur == nil {
+		return ErrNoKeyframe
+	}
+
+	format := x.cur.Format()
+	if format != PixelRGBA || r.Format() != format {
+		return ErrPixelFormat
+	}
+
+	rx, ry, rw, rh := r.X(), r.Y(), r.Width(), r.Height()
+	width, height := x.cur.Width(), x.cur.Height()
+	if rx < 0 || ry < 0 || rw <= 0 || rh <= 0 || rx+rw > width || ry+rh > height {
+		return ErrRectBounds
+	}
+
+	src, dst := r.Data(), x.cur.Data()
+	if len(src) != format.FrameSize(rw, rh) {
+		return ErrPayloadTruncated
+	}
+	for i := 0; i < rh; i++ {
+		copy(dst[4*((ry+i)*width+rx):], src[4*i*rw:4*(i+1)*rw])
+	}
+
+	x.cur.PtsSet(r.Pts())
+	return nil
+}
+
+// Current returns the current frame, or nil if no keyframe was applied.
+// The returned payload is only valid until the next Apply call.
+func (x *Framebuffer) Current() VideoPayload {
+	return x.cur
+}
+
+// FrameGate drops frames in excess of a target frame rate, based on their Pts spacing.
+type FrameGate struct {
+	interval time.Duration
+	next     time.Duration
+	started  bool
+}
+
+// NewFrameGate returns a gate admitting at most p.MaxFps frames per second. A non-positive MaxFps admits all frames.
+func NewFrameGate(p Primary) *FrameGate {
+	return &FrameGate{
+		interval: p.FrameInterval(),
+	}
+}
+
+// Allow reports whether a frame with the given Pts should be sent.
+// Frames arriving up to a quarter interval early are admitted, so that slight jitter doesn't halve the frame rate.
+// A Pts earlier than the last admitted one is taken as a discontinuity, such as a stream restart, and restarts the gate.
+// Out of order frames should therefore be filtered beforehand, see MonotonicChecker.
+func (x *FrameGate) Allow(pts time.Duration) bool {
+	if x.interval <= 0 {
+		return true
+	}
+	if x.started && pts < x.next-x.interval {
+		x.Reset()
+	}
+	if x.started && pts < x.next-x.interval/4 {
+		return false
+	}
+
+	base := x.next
+	if !x.started || pts > base {
+		base = pts
+	}
+	x.next = base + x.interval
+	x.started = true
+	return true
+}
+
+// Reset makes the gate admit the next frame regardless of its Pts, as after creation.
+func (x *FrameGate) Reset() {
+	x.started = false
+}
+
+// FrameRepeater keeps the last decoded frame, so it can be shown again when the next one is missing.
+type FrameRepeater struct {
+	MaxRepeats int // consecutive repeats after which a keyframe should be requested
+
+	last    VideoPayload
+	lastPts time.Duration
+	repeats int
+}
+
+// NeedKeyframe reports whether more than MaxRepeats consecutive repeats have occurred.
+func (x *FrameRepeater) NeedKeyframe() bool {
+	return x.repeats > x.MaxRepeats
+}
+
+// Observe must be called with each successfully decoded frame. Resets the repeat count.
+func (x *FrameRepeater) Observe(v VideoPayload) {
+	x.last = v
+	x.lastPts = v.Pts()
+	x.repeats = 0
+}
+
+// Repeat returns the frame to display at pts, in place of a missing one, or nil if no frame has been observed yet.
+// Calling it multiple times for the same pts counts as a single repeat.
+func (x *FrameRepeater) Repeat(pts time.Duration) VideoPayload {
+	if x.last == nil {
+		return nil
+	}
+	if pts > x.lastPts {
+		x.lastPts = pts
+		x.repeats++
+	}
+	return x.last
+}
+
+// Repeats returns the current number of consecutive repeats.
+func (x *FrameRepeater) Repeats() int {
+	return x.repeats
+}
+
+// FromMillis converts a millisecond timestamp, as received from C#.
+func FromMillis(ms int64) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
+
+// InputEvent is the structured form of a single encoded input event.
+// Only the fields relevant to its Kind are used. Targeted kinds use the same fields as their untargeted counterparts, plus Target.
+type InputEvent struct {
+	Kind   InputKind  `json:"kind"`
+	Key    string     `json:"key,omitempty"`    // InputKeyDown, InputKeyUp
+	Delta  int8       `json:"delta,omitempty"`  // InputScroll
+	DX     int16      `json:"dx,omitempty"`     // InputScrollUnit
+	DY     int16      `json:"dy,omitempty"`     // InputScrollUnit
+	Unit   ScrollUnit `json:"unit,omitempty"`   // InputScrollUnit
+	X      uint16     `json:"x,omitempty"`      // InputVector, InputContextMenu
+	Y      uint16     `json:"y,omitempty"`      // InputVector, InputContextMenu
+	Target uint8      `json:"target,omitempty"` // InputVectorTo, InputKeyDownTo, InputKeyUpTo, InputScrollUnitTo, InputContextMenuTo
+	Fps    float32    `json:"fps,omitempty"`    // InputRequestFps, InputWebcamFps
+}
+
+type InputKind byte
+
+// untargeted returns the kind that x tags with a target subsystem, or false if x is not a targeted kind.
+// Targeted events are encoded as their kind and target bytes, followed by the encoding of the untargeted event without its kind.
+func (x InputKind) untargeted() (InputKind, bool) {
+	switch x {
+	case InputVectorTo:
+		return InputVector, true
+	case InputKeyDownTo:
+		return InputKeyDown, true
+	case InputKeyUpTo:
+		return InputKeyUp, true
+	case InputScrollUnitTo:
+		return InputScrollUnit, true
+	case InputContextMenuTo:
+		return InputContextMenu, true
+	}
+	return x, false
+}
+
+// InputMask returns a bitmask of the given kinds, as used by Primary.InputKinds.
+func InputMask(kinds ...InputKind) uint32 {
+	var x uint32
+	for _, k := range kinds {
+		x |= 1 << k
+	}
+	return x
+}
+
+type InputPayload []byte
+
+func MakeInputPayload() InputPayload {
+	return make(InputPayload, 8)
+}
+
+// ParseInputPayload validates received input, without copying it.
+func ParseInputPayload(b []byte) (InputPayload, error) {
+	if len(b) > MaxInputPayloadSize {
+		return nil, ErrInputTooLarge
+	}
+	if len(b) < 8 {
+		return nil, ErrInputMalformed
+	}
+
+	for events := b[8:]; len(events) > 0; {
+		_, _, rest, err := nextInputEvent(events)
+		if err != nil {
+			return nil, err
+		}
+		events = rest
+	}
+	return InputPayload(b), nil
+}
+
+// AppendContextMenu appends a request to open a context menu at the given position, encoded like a vector.
+// Clients should emit it instead of leaving the engine to infer it from button or touch timing.
+func (x InputPayload) AppendContextMenu(xPos, yPos uint16) InputPayload {
+	x = append(x, byte(InputContextMenu))
+	return x.appendPosition(xPos, yPos)
+}
+
+// AppendContextMenuTo is like AppendContextMenu, for the given target subsystem, see AppendVectorTo.
+func (x InputPayload) AppendContextMenuTo(target uint8, xPos, yPos uint16) InputPayload {
+	x = append(x, byte(InputContextMenuTo), target)
+	return x.appendPosition(xPos, yPos)
+}
+
+// AppendEvent appends the encoded form of e. Returns ErrInputMalformed if e has an unknown Kind or an oversized Key.
+func (x InputPayload) AppendEvent(e InputEvent) (InputPayload, error) {
+	switch e.Kind {
+	case InputKeyDown, InputKeyUp:
+		if len(e.Key) > 255 {
+			return x, ErrInputMalformed
+		}
+		return x.appendKey(e.Kind, e.Key), nil
+	case InputScroll:
+		return x.AppendScroll(e.Delta), nil
+	case InputVector:
+		return x.AppendVector(e.X, e.Y), nil
+	case InputScrollUnit:
+		return x.AppendScrollUnit(e.DX, e.DY, e.Unit), nil
+	case InputRequestFps:
+		return x.AppendRequestFps(e.Fps), nil
+	case InputWebcamFps:
+		return x.AppendWebcamFps(e.Fps), nil
+	case InputContextMenu:
+		return x.AppendContextMenu(e.X, e.Y), nil
+	case InputFocusLost:
+		return x.AppendFocusLost(), nil
+	case InputVectorTo:
+		return x.AppendVectorTo(e.Target, e.X, e.Y), nil
+	case InputKeyDownTo, InputKeyUpTo:
+		if len(e.Key) > 255 {
+			return x, ErrInputMalformed
+		}
+		return x.appendKeyTo(e.Kind, e.Target, e.Key), nil
+	case InputScrollUnitTo:
+		return x.AppendScrollUnitTo(e.Target, e.DX, e.DY, e.Unit), nil
+	case InputContextMenuTo:
+		return x.AppendContextMenuTo(e.Target, e.X, e.Y), nil
+	}
+	return x, ErrInputMalformed
+}
+
+// AppendFocusLost signals that the client session lost focus, so key up events for currently held keys will never arrive.
+// On receipt, the engine should synthesize key up events for all held keys.
+func (x InputPayload) AppendFocusLost() InputPayload {
+	return append(x, byte(InputFocusLost))
+}
+
+func (x InputPayload) AppendKeyDown(key string) InputPayload {
+	return x.appendKey(InputKeyDown, key)
+}
+
+// AppendKeyDownTo is like AppendKeyDown, for the given target subsystem, see AppendVectorTo.
+// It lets keyboard input typed into an overlay UI be routed away from the game.
+func (x InputPayload) AppendKeyDownTo(target uint8, key string) InputPayload {
+	return x.appendKeyTo(InputKeyDownTo, target, key)
+}
+
+func (x InputPayload) AppendKeyUp(key string) InputPayload {
+	return x.appendKey(InputKeyUp, key)
+}
+
+// AppendKeyUpTo is like AppendKeyUp, for the given target subsystem, see AppendVectorTo.
+func (x InputPayload) AppendKeyUpTo(target uint8, key string) InputPayload {
+	return x.appendKeyTo(InputKeyUpTo, target, key)
+}
+
+// AppendRequestFps appends a frame rate change request, encoded as a float32.
+// The engine should clamp the value using Primary.ClampFps before adjusting its output pacing.
+func (x InputPayload) AppendRequestFps(fps float32) InputPayload {
+	b := *(*[4]byte)(unsafe.Pointer(&fps))
+	return append(x, byte(InputRequestFps), b[0], b[1], b[2], b[3])
+}
+
+func (x InputPayload) AppendScroll(delta int8) InputPayload {
+	return append(x, byte(InputScroll), byte(delta))
+}
+
+// AppendScrollUnit appends a two axis scroll event, with deltas measured in the given unit.
+// Encoded as the unit byte followed by dx and dy.
+func (x InputPayload) AppendScrollUnit(dx, dy int16, unit ScrollUnit) InputPayload {
+	x = append(x, byte(InputScrollUnit), byte(unit))
+	return x.appendDeltas(dx, dy)
+}
+
+// AppendScrollUnitTo is like AppendScrollUnit, for the given target subsystem, see AppendVectorTo.
+func (x InputPayload) AppendScrollUnitTo(target uint8, dx, dy int16, unit ScrollUnit) InputPayload {
+	x = append(x, byte(InputScrollUnitTo), target, byte(unit))
+	return x.appendDeltas(dx, dy)
+}
+
+func (x InputPayload) AppendVector(xPos, yPos uint16) InputPayload {
+	x = append(x, byte(InputVector))
+	return x.appendPosition(xPos, yPos)
+}
+
+// AppendVectorTo appends a vector destined for a specific engine subsystem, such as an overlay UI instead of the game surface.
+// Target 0 is the default subsystem, equivalent to AppendVector. Other values are engine defined.
+// Key, scroll and context menu events have targeted variants as well.
+func (x InputPayload) AppendVectorTo(target uint8, xPos, yPos uint16) InputPayload {
+	x = append(x, byte(InputVectorTo), target)
+	return x.appendPosition(xPos, yPos)
+}
+
+// AppendWebcamFps appends a webcam frame rate cap, encoded as a float32. 0 means uncapped.
+// It is sent by the engine to a secondary, which applies it to Secondary.WebcamMaxFps and acknowledges by echoing the applied rate.
+func (x InputPayload) AppendWebcamFps(fps float32) InputPayload {
+	b := *(*[4]byte)(unsafe.Pointer(&fps))
+	return append(x, byte(InputWebcamFps), b[0], b[1], b[2], b[3])
+}
+
+func (x InputPayload) Bytes() []byte {
+	return x
+}
+
+// Coalesce returns a copy of x in which each run of consecutive vector events is reduced to its last one.
+// Targeted vectors only coalesce with vectors of the same target.
+// A vector is only dropped in favour of one that immediately follows it, so the order of all other events relative to the surviving vectors is preserved.
+// This keeps position dependent actions, such as a click following a move, at the intended position.
+// Malformed trailing data is copied unchanged.
+func (x InputPayload) Coalesce() InputPayload {
+	y := make(InputPayload, 8, len(x))
+	copy(y, x[:8])
+
+	last := -1 // offset in y of the last event, if it's a vector
+	for b := x.Data(); len(b) > 0; {
+		kind, event, rest, err := nextInputEvent(b)
+		if err != nil {
+			return append(y, b...)
+		}
+		b = rest
+
+		if kind != InputVector && kind != InputVectorTo {
+			y = append(y, event...)
+			last = -1
+			continue
+		}
+
+		head := event[:len(event)-4] // kind, and target if present
+		if last >= 0 && bytes.Equal(y[last:last+len(head)], head) {
+			y = y[:last]
+		}
+		last = len(y)
+		y = append(y, event...)
+	}
+	return y
+}
+
+func (x InputPayload) Data() []byte {
+	return x[8:]
+}
+
+// Events decodes all events in x.
+func (x InputPayload) Events() ([]InputEvent, error) {
+	var o []InputEvent
+	for b := x.Data(); len(b) > 0; {
+		kind, event, rest, err := nextInputEvent(b)
+		if err != nil {
+			return nil, err
+		}
+		b = rest
+
+		e := InputEvent{Kind: kind}
+		base, target, body := splitInputEvent(event)
+		e.Target = target
+		switch base {
+		case InputKeyDown, InputKeyUp:
+			e.Key = string(body[1:])
+		case InputScroll:
+			e.Delta = int8(body[0])
+		case InputVector, InputContextMenu:
+			e.X = *(*uint16)(unsafe.Pointer(&body[0]))
+			e.Y = *(*uint16)(unsafe.Pointer(&body[2]))
+		case InputScrollUnit:
+			e.Unit = ScrollUnit(body[0])
+			e.DX = *(*int16)(unsafe.Pointer(&body[1]))
+			e.DY = *(*int16)(unsafe.Pointer(&body[3]))
+		case InputRequestFps, InputWebcamFps:
+			e.Fps = *(*float32)(unsafe.Pointer(&body[0]))
+		}
+		o = append(o, e)
+	}
+	return o, nil
+}
+
+func (x InputPayload) IsEmpty() bool {
+	if len(x) == 8 {
+		return true
+	}
+	return false
+}
+
+func (x InputPayload) Kind() PacketKind {
+	return PacketInput
+}
+
+// KeyTranscript returns the characters typed through InputKeyDown and InputKeyDownTo events, in order.
+// Named keys, such as modifiers or "Enter", are skipped, as are all other events.
+func (x InputPayload) KeyTranscript() (string, error) {
+	var s []byte
+	for b := x.Data(); len(b) > 0; {
+		_, event, rest, err := nextInputEvent(b)
+		if err != nil {
+			return "", err
+		}
+		b = rest
+
+		base, _, body := splitInputEvent(event)
+		if base != InputKeyDown {
+			continue
+		}
+		if key := body[1:]; utf8.RuneCount(key) == 1 {
+			s = append(s, key...)
+		}
+	}
+	return string(s), nil
+}
+
+// MarshalJSON encodes the events of x as an array of InputEvent objects.
+// Ts is not included, as JSON clients don't share the engine's clock; receivers should use Stamp instead.
+// A payload too short to hold a Ts, such as a zero value, encodes as null.
+func (x InputPayload) MarshalJSON() ([]byte, error) {
+	if len(x) < 8 {
+		return []byte("null"), nil
+	}
+
+	events, err := x.Events()
+	if err != nil {
+		return nil, err
+	}
+	if events == nil {
+		events = []InputEvent{}
+	}
+	return json.Marshal(events)
+}
+
+// RemapKeys returns a copy of x, with the keys of key events replaced according to table.
+// Unmapped keys, all other events, and any malformed trailing data are copied unchanged.
+func (x InputPayload) RemapKeys(table map[string]string) InputPayload {
+	y := make(InputPayload, 8, len(x))
+	copy(y, x[:8])
+
+	for b := x.Data(); len(b) > 0; {
+		kind, event, rest, err := nextInputEvent(b)
+		if err != nil {
+			return append(y, b...)
+		}
+		b = rest
+
+		if base, target, body := splitInputEvent(event); base == InputKeyDown || base == InputKeyUp {
+			if key, ok := table[string(body[1:])]; ok && len(key) <= 255 {
+				if base == kind {
+					y = y.appendKey(kind, key)
+				} else {
+					y = y.appendKeyTo(kind, target, key)
+				}
+				continue
+			}
+		}
+		y = append(y, event...)
+	}
+	return y
+}
+
+// Reset can be used to compose a new InputPayload, without reallocation.
+func (x InputPayload) Reset() InputPayload {
+	return x[:8]
+}
+
+// SplitBySize splits the events of x into payloads holding at most maxData bytes of event data each, all with the same Ts.
+// Events are never split, so an event larger than maxData gets a payload of its own.
+// Returns nil if x is malformed.
+func (x InputPayload) SplitBySize(maxData int) []InputPayload {
+	ts := x.Ts()
+	newPayload := func() InputPayload {
+		y := MakeInputPayload()
+		y.TsSet(ts)
+		return y
+	}
+
+	var o []InputPayload
+	y := newPayload()
+	for b := x.Data(); len(b) > 0; {
+		_, event, rest, err := nextInputEvent(b)
+		if err != nil {
+			return nil
+		}
+		b = rest
+
+		if !y.IsEmpty() && len(y.Data())+len(event) > maxData {
+			o = append(o, y)
+			y = newPayload()
+		}
+		y = append(y, event...)
+	}
+	return append(o, y)
+}
+
+// Stamp sets Ts to the current time, as returned by Now.
+func (x InputPayload) Stamp() {
+	x.TsSet(Now())
+}
+
+func (x InputPayload) Ts() time.Duration {
+	return *(*time.Duration)(unsafe.Pointer(&x[0])) // int64
+}
+
+func (x InputPayload) TsSet(ts time.Duration) {
+	b := *(*[8]byte)(unsafe.Pointer(&ts))
+	copy(x, b[:])
+}
+
+// UnmarshalJSON replaces the events of x with those decoded from an array of InputEvent objects.
+// Ts is left unchanged.
+func (x *InputPayload) UnmarshalJSON(b []byte) error {
+	var events []InputEvent
+	if err := json.Unmarshal(b, &events); err != nil {
+		return err
+	}
+
+	y := *x
+	if len(y) < 8 {
+		y = MakeInputPayload()
+	}
+	y = y.Reset()
+
+	for _, e := range events {
+		var err error
+		if y, err = y.AppendEvent(e); err != nil {
+			return err
+		}
+	}
+	*x = y
+	return nil
+}
+
+func (x InputPayload) appendDeltas(dx, dy int16) InputPayload {
+	b := *(*[2]byte)(unsafe.Pointer(&dx))
+	x = append(x, b[0], b[1])
+
+	b = *(*[2]byte)(unsafe.Pointer(&dy))
+	return append(x, b[0], b[1])
+}
+
+func (x InputPayload) appendKey(kind InputKind, key string) InputPayload {
+	x = append(x, byte(kind))
+	x = append(x, byte(len(key)))
+	x = append(x, key...)
+	return x
+}
+
+func (x InputPayload) appendKeyTo(kind InputKind, target uint8, key string) InputPayload {
+	x = append(x, byte(kind), target)
+	x = append(x, byte(len(key)))
+	x = append(x, key...)
+	return x
+}
+
+func (x InputPayload) appendPosition(xPos, yPos uint16) InputPayload {
+	b := *(*[2]byte)(unsafe.Pointer(&xPos))
+	x = append(x, b[0], b[1])
+
+	b = *(*[2]byte)(unsafe.Pointer(&yPos))
+	return append(x, b[0], b[1])
+}
+
+type monotonicClock struct{}
+
+func (monotonicClock) Now() time.Duration {
+	return time.Since(epoch)
+}
+
+// nextInputEvent splits the first event off of encoded input events, returning its kind, its full encoding and the remaining events.
+func nextInputEvent(b []byte) (kind InputKind, event, rest []byte, err error) {
+	kind = InputKind(b[0])
+
+	n := 1 // kind, and target if present
+	base, targeted := kind.untargeted()
+	if targeted {
+		n = 2
+	}
+
+	switch base {
+	case InputKeyDown, InputKeyUp:
+		if len(b) < n+1 {
+			return 0, nil, nil, ErrInputMalformed
+		}
+		n += 1 + int(b[n])
+	case InputFocusLost:
+	case InputScroll:
+		n += 1
+	case InputVector, InputRequestFps, InputWebcamFps, InputContextMenu:
+		n += 4
+	case InputScrollUnit:
+		n += 5
+	default:
+		return 0, nil, nil, ErrInputMalformed
+	}
+
+	if len(b) < n {
+		return 0, nil, nil, ErrInputMalformed
+	}
+	return kind, b[:n], b[n:], nil
+}
+
+// splitInputEvent returns the untargeted kind of an event returned by nextInputEvent, its target, and its encoding following the kind and target.
+func splitInputEvent(event []byte) (base InputKind, target uint8, body []byte) {
+	base, targeted := InputKind(event[0]).untargeted()
+	if targeted {
+		return base, event[1], event[2:]
+	}
+	return base, 0, event[1:]
+}
+
+// InputSampler throttles vector events to a Primary's negotiated InputRate, to save bandwidth on constrained clients.
+// Discrete events are not throttled, but Flush must be called before appending them.
+type InputSampler struct {
+	interval time.Duration
+	last     time.Duration
+	started  bool
+
+	pending    bool
+	xPos, yPos uint16
+}
+
+// NewInputSampler clamps a non-zero p.InputRate between InputRateMin and InputRateMax.
+func NewInputSampler(p Primary) *InputSampler {
+	rate := p.InputRate
+	if rate == 0 {
+		return &InputSampler{}
+	}
+	if rate < InputRateMin {
+		rate = InputRateMin
+	}
+	if rate > InputRateMax {
+		rate = InputRateMax
+	}
+	return &InputSampler{
+		interval: time.Duration(float64(time.Second) / float64(rate)),
+	}
+}
+
+// AppendVector appends a vector event sampled at time t, if enough time has passed since the last one.
+// Otherwise, the vector is held back, replacing any previously held one.
+func (x *InputSampler) AppendVector(p InputPayload, xPos, yPos uint16, t time.Duration) InputPayload {
+	if x.started && t < x.last+x.interval {
+		x.pending, x.xPos, x.yPos = true, xPos, yPos
+		return p
+	}
+
+	x.pending = false
+	x.last = t
+	x.started = true
+	return p.AppendVector(xPos, yPos)
+}
+
+// Flush appends the held back vector, if any, so that a following discrete event applies at the latest pointer position.
+func (x *InputSampler) Flush(p InputPayload) InputPayload {
+	if !x.pending {
+		return p
+	}
+	x.pending = false
+	return p.AppendVector(x.xPos, x.yPos)
+}
+
+// LatencyParts attributes a frame's end to end latency.
+type LatencyParts struct {
+	Network   time.Duration // from being sent until being received
+	Buffering time.Duration // from being received until being displayed
+}
+
+func (x LatencyParts) Total() time.Duration {
+	return x.Network + x.Buffering
+}
+
+// MetaPayload carries a single key-value pair, outside of media timing.
+// Encoded as the key length byte, followed by the key and the value.
+// Receivers should ignore keys they don't recognize.
+type MetaPayload []byte
+
+// MakeMetaPayload panics if key is longer than 255 bytes.
+func MakeMetaPayload(key string, value []byte) MetaPayload {
+	if len(key) > 255 {
+		panic("meta key too long")
+	}
+
+	x := make(MetaPayload, 1+len(key)+len(value))
+	x[0] = byte(len(key))
+	copy(x[1:], key)
+	copy(x[1+len(key):], value)
+	return x
+}
+
+// ParseMetaPayload validates received metadata, without copying it.
+func ParseMetaPayload(b []byte) (MetaPayload, error) {
+	if len(b) < 1 || 1+int(b[0]) > len(b) {
+		return nil, ErrPayloadTruncated
+	}
+	return MetaPayload(b), nil
+}
+
+func (x MetaPayload) Bytes() []byte {
+	return x
+}
+
+func (x MetaPayload) Key() string {
+	return string(x[1 : 1+int(x[0])])
+}
+
+func (x MetaPayload) Kind() PacketKind {
+	return PacketMeta
+}
+
+// Ts always returns 0, as metadata is untimed.
+func (x MetaPayload) Ts() time.Duration {
+	return 0
+}
+
+func (x MetaPayload) Value() []byte {
+	return x[1+int(x[0]):]
+}
+
+// MonotonicChecker rejects video frames that would be presented out of Pts order.
+type MonotonicChecker struct {
+	last    time.Duration
+	started bool
+}
+
+// Observe returns false if v has an earlier Pts than a previously accepted frame, in which case it should be dropped.
+// Accepted frames are assumed to be presented.
+func (x *MonotonicChecker) Observe(v VideoPayload) bool {
+	pts := v.Pts()
+	if x.started && pts < x.last {
+		return false
+	}
+	x.last = pts
+	x.started = true
+	return true
+}
+
+// Now returns the current time of DefaultClock, which by default is the monotonic time elapsed since the package was initialized.
+// All timestamps within a session, such as input Ts and video Pts, should be derived from it, so that they are comparable.
+func Now() time.Duration {
+	return DefaultClock.Now()
+}
+
+// OptimalFragmentSize returns the payload size to use when splitting totalPayload bytes into packets of at most mtu bytes.
+// It uses the least number of fragments, with sizes as even as possible. Returns 0 if mtu can't fit any payload.
+func OptimalFragmentSize(mtu, totalPayload int) int {
+	limit := mtu - PacketHeaderSize
+	if limit <= 0 {
+		return 0
+	}
+	if totalPayload <= limit {
+		return totalPayload
+	}
+
+	n := (totalPayload + limit - 1) / limit
+	return (totalPayload + n - 1) / n
+}
+
+// OverlayPayload holds an RGBA layer, to be alpha blended over a region of the base video frame.
+// Unlike the base frame, it doesn't replace pixels. Overlays have their own Pts, so they can update at a different rate than the base stream.
+// The header is laid out as:
+//
+//	0  Pts
+//	8  x (int32)
+//	12 y (int32)
+//	16 width (int32)
+//	20 height (int32)
+//
+// followed by the non-premultiplied RGBA pixel data.
+type OverlayPayload []byte
+
+// MakeOverlayPayload returns nil if the overlay has no area.
+func MakeOverlayPayload(xPos, yPos, width, height int) OverlayPayload {
+	n := PixelRGBA.FrameSize(width, height)
+	if n == 0 {
+		return nil
+	}
+
+	x := make(OverlayPayload, overlayHeaderSize+n)
+	x.XSet(xPos)
+	x.YSet(yPos)
+	x.WidthSet(width)
+	x.HeightSet(height)
+	return x
+}
+
+// ParseOverlayPayload validates a received overlay, without copying it.
+func ParseOverlayPayload(b []byte) (OverlayPayload, error) {
+	if len(b) < overlayHeaderSize {
+		return nil, ErrPayloadTruncated
+	}
+
+	x := OverlayPayload(b)
+	if n := PixelRGBA.FrameSize(x.Width(), x.Height()); n == 0 || len(x.Data()) != n {
+		return nil, ErrPayloadTruncated
+	}
+	return x, nil
+}
+
+func (x OverlayPayload) Bytes() []byte {
+	return x
+}
+
+func (x OverlayPayload) Data() []byte {
+	return x[overlayHeaderSize:]
+}
+
+func (x OverlayPayload) Height() int {
+	return int(*(*int32)(unsafe.Pointer(&x[20])))
+}
+
+func (x OverlayPayload) HeightSet(height int) {
+	putInt32(x[20:], height)
+}
+
+func (x OverlayPayload) Kind() PacketKind {
+	return PacketOverlay
+}
+
+func (x OverlayPayload) Pts() time.Duration {
+	return *(*time.Duration)(unsafe.Pointer(&x[0])) // int64
+}
+
+func (x OverlayPayload) PtsSet(t time.Duration) {
+	b := *(*[8]byte)(unsafe.Pointer(&t))
+	copy(x, b[:])
+}
+
+// Ts is the same as Pts.
+func (x OverlayPayload) Ts() time.Duration {
+	return x.Pts()
+}
+
+func (x OverlayPayload) Width() int {
+	return int(*(*int32)(unsafe.Pointer(&x[16])))
+}
+
+func (x OverlayPayload) WidthSet(width int) {
+	putInt32(x[16:], width)
+}
+
+func (x OverlayPayload) X() int {
+	return int(*(*int32)(unsafe.Pointer(&x[8])))
+}
+
+func (x OverlayPayload) XSet(xPos int) {
+	putInt32(x[8:], xPos)
+}
+
+func (x OverlayPayload) Y() int {
+	return int(*(*int32)(unsafe.Pointer(&x[12])))
+}
+
+func (x OverlayPayload) YSet(yPos int) {
+	putInt32(x[12:], yPos)
+}
+
+// Packet is the unit of transmission. The header is laid out as:
+//
+//	0  Id
+//	8  PacketKind
+//	9  payload size (uint64)
+//	17 TTL
+//
+// followed by the payload. All fields use the host byte order.
+//
+// For bandwidth constrained connections carrying mostly small packets, both ends may agree during the handshake to use the compact encoding instead, see EncodeCompact.
+//
+// A Packet is a view over its underlying bytes, as are the payloads obtained from it.
+// It is safe to read concurrently, but must not be read while being modified, including through any of its payloads.
+type Packet []byte
+
+// DecodeCompact converts the compact encoded packet at the start of b back to the fixed format, also returning the number of bytes consumed.
+// It can't detect fixed format input, which is decoded as garbage; connections must use one encoding throughout.
+func DecodeCompact(b []byte) (Packet, int, error) {
+	if len(b) < 2 {
+		return nil, 0, ErrPacketSize
+	}
+	kind, ttl := PacketKind(b[0]), b[1]
+	n := 2
+
+	id, m := binary.Uvarint(b[n:])
+	if m <= 0 {
+		return nil, 0, ErrPacketSize
+	}
+	n += m
+
+	size, m := binary.Uvarint(b[n:])
+	if m <= 0 {
+		return nil, 0, ErrPacketSize
+	}
+	n += m
+
+	if size > uint64(len(b)-n) {
+		return nil, 0, ErrPacketSize
+	}
+	x := MakePacket(int(size))
+	x.IdSet(id)
+	x.KindSet(kind)
+	x.TTLSet(ttl)
+	copy(x.Payload(), b[n:])
+	return x, n + int(size), nil
+}
+
+func MakePacket(payloadSize int) Packet {
+	x := make(Packet, PacketHeaderSize+payloadSize)
+	x.SizeSet(payloadSize)
+	x.TTLSet(DefaultTTL)
+	return x
+}
+
+// PacketFrom constructs a packet of the appropriate kind, holding a copy of p.
+func PacketFrom(id uint64, p Payload) Packet {
+	b := p.Bytes()
+	x := MakePacket(len(b))
+	x.IdSet(id)
+	x.KindSet(p.Kind())
+	copy(x.Payload(), b)
+	return x
+}
+
+// ParsePacket validates the header of received data, returning the packet at its start, without copying.
+// Any data following the packet's payload is excluded.
+// The size is checked as a uint64, so that oversized or hostile values can't wrap around on 32-bit platforms.
+func ParsePacket(b []byte) (Packet, error) {
+	if len(b) < PacketHeaderSize {
+		return nil, ErrPacketSize
+	}
+
+	size := *(*uint64)(unsafe.Pointer(&b[9]))
+	if size > uint64(len(b)-PacketHeaderSize) {
+		return nil, ErrPacketSize
+	}
+	return Packet(b[:PacketHeaderSize+int(size)]), nil
+}
+
+// DecTTL decrements the packet's TTL, and must be called by relays before forwarding it.
+// Returns false if the TTL was exhausted, in which case the packet must be dropped.
+func (x Packet) DecTTL() bool {
+	if x[17] == 0 {
+		return false
+	}
+	x[17]--
+	return x[17] > 0
+}
+
+// EncodeCompact returns x in the compact encoding, which replaces the fixed size Id and Size fields with uvarints:
+//
+//	PacketKind
+//	TTL
+//	Id (uvarint)
+//	payload size (uvarint)
+//
+// followed by the payload. Header overhead drops from 18 bytes to as few as 4, which matters for high rate input and sync packets.
+// The encoding carries no marker, as the fixed format has no byte a marker could be distinguished from.
+// Both ends must therefore agree on it per connection, during the handshake, and never mix the two.
+func (x Packet) EncodeCompact() []byte {
+	payload := x.Payload()
+	o := make([]byte, 2, 2+2*binary.MaxVarintLen64+len(payload))
+	o[0] = byte(x.Kind())
+	o[1] = x.TTL()
+	o = appendUvarint(o, x.Id())
+	o = appendUvarint(o, uint64(len(payload)))
+	return append(o, payload...)
+}
+
+func (x Packet) Id() uint64 {
+	return *(*uint64)(unsafe.Pointer(&x[0]))
+}
+
+func (x Packet) IdSet(id uint64) {
+	b := *(*[8]byte)(unsafe.Pointer(&id))
+	copy(x, b[:])
+}
+
+func (x Packet) Kind() PacketKind {
+	return PacketKind(x[8])
+}
+
+func (x Packet) KindSet(kind PacketKind) {
+	x[8] = byte(kind)
+}
+
+func (x Packet) Payload() []byte {
+	return x[PacketHeaderSize:]
+}
+
+// PayloadSet copies b into the packet, reallocating it if the copy doesn't fit.
+func (x Packet) PayloadSet(b []byte) {
+	x = append(x[:PacketHeaderSize], b...)
+	x.SizeSet(len(b))
+}
+
+// Size returns the payload size.
+// The result is only meaningful for packets obtained through ParsePacket or MakePacket, as a corrupt size may not fit an int.
+func (x Packet) Size() int {
+	return int(*(*uint64)(unsafe.Pointer(&x[9])))
+}
+
+func (x Packet) SizeSet(size int) {
+	// store as uint64 for portability
+	sz := uint64(size)
+	b := *(*[8]byte)(unsafe.Pointer(&sz))
+	copy(x[9:], b[:])
+}
+
+// TTL returns the number of relay hops remaining.
+func (x Packet) TTL() uint8 {
+	return x[17]
+}
+
+func (x Packet) TTLSet(ttl uint8) {
+	x[17] = ttl
+}
+
+// WritePackets concatenates packets into a single write.
+func WritePackets(w io.Writer, packets ...Packet) error {
+	var n int
+	for _, p := range packets {
+		n += len(p)
+	}
+
+	b := make([]byte, 0, n)
+	for _, p := range packets {
+		b = append(b, p...)
+	}
+	return w.Write(b)
+}
+
+type PacketKind byte
+
+// Droppable reports whether packets of this kind may be discarded under backpressure.
+// Only live video, where a later frame supersedes an earlier one, is droppable.
+func (x PacketKind) Droppable() bool {
+	switch x {
+	case PacketVideo:
+		return true
+	}
+	return false
+}
+
+// Payload is implemented by all packet payload types.
+type Payload interface {
+	Bytes() []byte // full payload, including header
+	Kind() PacketKind
+	Ts() time.Duration
+}
+
+// PixelFormat defines the layout of VideoPayload pixel data.
+type PixelFormat byte
+
+// FrameSize returns the size of a frame's pixel data, or 0 if the format is unknown or the frame has no area.
+func (x PixelFormat) FrameSize(width, height int) int {
+	if width <= 0 || height <= 0 {
+		return 0
+	}
+
+	switch x {
+	case PixelRGBA:
+		return 4 * width * height
+	case PixelNV12:
+		return width*height + 2*((width+1)/2)*((height+1)/2)
+	}
+	return 0
+}
+
+// VideoPayloadSize returns 0 under the same conditions as FrameSize.
+func (x PixelFormat) VideoPayloadSize(width, height int) int {
+	n := x.FrameSize(width, height)
+	if n == 0 {
+		return 0
+	}
+	return videoHeaderSize + n
+}
+
+// PointerInterpolator smooths pointer movement by interpolating between the last two vector samples.
+type PointerInterpolator struct {
+	n      int // number of samples observed, up to 2
+	x0, y0 float64
+	x1, y1 float64
+	t0, t1 time.Duration
+}
+
+// At returns the pointer position at time t.
+// Times past the last sample are extrapolated by at most half a sample interval.
+func (x *PointerInterpolator) At(t time.Duration) (uint16, uint16) {
+	if x.n == 0 {
+		return 0, 0
+	}
+	if x.n == 1 || x.t1 <= x.t0 {
+		return uint16(x.x1), uint16(x.y1)
+	}
+	if t <= x.t0 {
+		return uint16(x.x0), uint16(x.y0)
+	}
+	if limit := x.t1 + (x.t1-x.t0)/2; t > limit {
+		t = limit
+	}
+
+	f := float64(t-x.t0) / float64(x.t1-x.t0)
+	return clampUint16(x.x0 + f*(x.x1-x.x0)), clampUint16(x.y0 + f*(x.y1-x.y0))
+}
+
+// Observe records a vector sample taken at time t.
+func (x *PointerInterpolator) Observe(xPos, yPos uint16, t time.Duration) {
+	x.x0, x.y0, x.t0 = x.x1, x.y1, x.t1
+	x.x1, x.y1, x.t1 = float64(xPos), float64(yPos), t
+	if x.n < 2 {
+		x.n++
+	}
+}
+
+func clampUint16(v float64) uint16 {
+	if v <= 0 {
+		return 0
+	}
+	if v >= 65535 {
+		return 65535
+	}
+	return uint16(v + 0.5)
+}
+
+// clampUnit clamps v to [0, 1]. NaN becomes 0.
+func clampUnit(v float64) float64 {
+	if !(v > 0) {
+		return 0
+	}
+	if v > 1 {
+		return 1
+	}
+	return v
+}
+
+// Primary defines primary client setup parameters for the rendering engine.
+type Primary struct {
+	Id           uint64
+	RenderWidth  int32
+	RenderHeight int32
+	WebcamWidth  int32
+	WebcamHeight int32
+	MaxFps       float32
+	YAxisUp      bool    // the client uses a bottom-left origin for vector input, instead of top-left; see FlipY
+	InputKinds   uint32  // set by the engine during negotiation; see InputMask and SupportsInput
+	InputRate    float32 // vector events per second, 0 meaning unthrottled; see InputSampler
+}
+
+// Acceptable returns an error wrapping ErrLimitExceeded for the first setting that is invalid or beyond limits.
+func (x Primary) Acceptable(limits EngineLimits) error {
+	switch {
+	case x.RenderWidth <= 0 || x.RenderHeight <= 0:
+		return fmt.Errorf("%w: render size %dx%d is empty", ErrLimitExceeded, x.RenderWidth, x.RenderHeight)
+	case limits.MaxRenderWidth > 0 && x.RenderWidth > limits.MaxRenderWidth:
+		return fmt.Errorf("%w: render width %d above %d", ErrLimitExceeded, x.RenderWidth, limits.MaxRenderWidth)
+	case limits.MaxRenderHeight > 0 && x.RenderHeight > limits.MaxRenderHeight:
+		return fmt.Errorf("%w: render height %d above %d", ErrLimitExceeded, x.RenderHeight, limits.MaxRenderHeight)
+	case x.WebcamWidth < 0 || x.WebcamHeight < 0:
+		return fmt.Errorf("%w: negative webcam size %dx%d", ErrLimitExceeded, x.WebcamWidth, x.WebcamHeight)
+	case limits.MaxWebcamWidth > 0 && x.WebcamWidth > limits.MaxWebcamWidth:
+		return fmt.Errorf("%w: webcam width %d above %d", ErrLimitExceeded, x.WebcamWidth, limits.MaxWebcamWidth)
+	case limits.MaxWebcamHeight > 0 && x.WebcamHeight > limits.MaxWebcamHeight:
+		return fmt.Errorf("%w: webcam height %d above %d", ErrLimitExceeded, x.WebcamHeight, limits.MaxWebcamHeight)
+	case x.MaxFps != x.MaxFps || x.MaxFps <= 0:
+		return fmt.Errorf("%w: fps %v is not positive", ErrLimitExceeded, x.MaxFps)
+	case limits.MaxFps > 0 && x.MaxFps > limits.MaxFps:
+		return fmt.Errorf("%w: fps %v above %v", ErrLimitExceeded, x.MaxFps, limits.MaxFps)
+	case x.InputRate != x.InputRate || x.InputRate < 0:
+		return fmt.Errorf("%w: input rate %v is negative or NaN", ErrLimitExceeded, x.InputRate)
+	case limits.InputKinds != 0 && x.InputKinds&^limits.InputKinds != 0:
+		return fmt.Errorf("%w: input kinds %#x not in %#x", ErrLimitExceeded, x.InputKinds, limits.InputKinds)
+	}
+	return nil
+}
+
+func (x Primary) AsSecondary() Secondary {
+	return Secondary{
+		Id:           x.Id,
+		WebcamWidth:  x.WebcamWidth,
+		WebcamHeight: x.WebcamHeight,
+	}
+}
+
+// ClampFps limits a requested frame rate to the range negotiated by the Primary.
+// Non-positive and NaN values are treated as a request for the maximum rate.
+func (x Primary) ClampFps(fps float32) float32 {
+	if fps != fps || fps <= 0 || fps > x.MaxFps {
+		return x.MaxFps
+	}
+	return fps
+}
+
+// FrameInterval returns the time between frames at MaxFps, or 0 if MaxFps is not positive.
+func (x Primary) FrameInterval() time.Duration {
+	if x.MaxFps <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / float64(x.MaxFps))
+}
+
+// MarshalBinary encodes x as:
+//
+//	0  Id
+//	8  RenderWidth
+//	12 RenderHeight
+//	16 WebcamWidth
+//	20 WebcamHeight
+//	24 MaxFps
+//	28 InputKinds
+//	32 InputRate
+//	36 YAxisUp
+//
+// Fields added in later versions are appended, so decoders must ignore trailing data.
+func (x Primary) MarshalBinary() ([]byte, error) {
+	b := make([]byte, primaryBinarySize)
+	copy(b, (*[8]byte)(unsafe.Pointer(&x.Id))[:])
+	putInt32(b[8:], int(x.RenderWidth))
+	putInt32(b[12:], int(x.RenderHeight))
+	putInt32(b[16:], int(x.WebcamWidth))
+	putInt32(b[20:], int(x.WebcamHeight))
+	copy(b[24:], (*[4]byte)(unsafe.Pointer(&x.MaxFps))[:])
+	copy(b[28:], (*[4]byte)(unsafe.Pointer(&x.InputKinds))[:])
+	copy(b[32:], (*[4]byte)(unsafe.Pointer(&x.InputRate))[:])
+	if x.YAxisUp {
+		b[36] = 1
+	}
+	return b, nil
+}
+
+// MatchesSecondary reports whether s has the same Id and webcam dimensions as x, as it would if derived through AsSecondary.
+func (x Primary) MatchesSecondary(s Secondary) bool {
+	return s.Id == x.Id && s.WebcamWidth == x.WebcamWidth && s.WebcamHeight == x.WebcamHeight
+}
+
+// MinLatency returns the best achievable latency for x, as a reference for measured latency.
+// Frames can't be delivered faster than the frame cadence, so it is one FrameInterval plus MinLatencyFloor.
+func (x Primary) MinLatency() time.Duration {
+	return x.FrameInterval() + MinLatencyFloor
+}
+
+// QuantizeFps returns a copy of x with MaxFps quantized to one of the supported rates. See the QuantizeFps function.
+func (x Primary) QuantizeFps(supported []float32) Primary {
+	x.MaxFps = QuantizeFps(x.MaxFps, supported)
+	return x
+}
+
+// ReconfigurePacket returns a PacketReconfigure pushing x to the client in-band.
+func (x Primary) ReconfigurePacket() Packet {
+	b, _ := x.MarshalBinary()
+	o := MakePacket(len(b))
+	o.IdSet(x.Id)
+	o.KindSet(PacketReconfigure)
+	copy(o.Payload(), b)
+	return o
+}
+
+// SupportsInput reports whether the engine handles events of the given kind, so clients can avoid sending the rest.
+// An empty mask means that all kinds are supported.
+func (x Primary) SupportsInput(k InputKind) bool {
+	return x.InputKinds == 0 || x.InputKinds&(1<<k) != 0
+}
+
+// Tier classifies x by render area and frame rate. Invalid dimensions classify as TierSD.
+func (x Primary) Tier() QualityTier {
+	if x.RenderWidth <= 0 || x.RenderHeight <= 0 {
+		return TierSD
+	}
+
+	var tier QualityTier
+	switch pixels := int(x.RenderWidth) * int(x.RenderHeight); {
+	case pixels >= Tier4KPixels:
+		tier = Tier4K
+	case pixels >= TierFHDPixels:
+		tier = TierFHD
+	case pixels >= TierHDPixels:
+		tier = TierHD
+	default:
+		return TierSD
+	}
+
+	if !(x.MaxFps >= TierMinFps) { // also catches NaN
+		tier--
+	}
+	return tier
+}
+
+// UnmarshalBinary decodes the output of MarshalBinary, ignoring any trailing data.
+func (x *Primary) UnmarshalBinary(b []byte) error {
+	if len(b) < primaryBinarySize {
+		return ErrPayloadTruncated
+	}
+
+	x.Id = *(*uint64)(unsafe.Pointer(&b[0]))
+	x.RenderWidth = *(*int32)(unsafe.Pointer(&b[8]))
+	x.RenderHeight = *(*int32)(unsafe.Pointer(&b[12]))
+	x.WebcamWidth = *(*int32)(unsafe.Pointer(&b[16]))
+	x.WebcamHeight = *(*int32)(unsafe.Pointer(&b[20]))
+	x.MaxFps = *(*float32)(unsafe.Pointer(&b[24]))
+	x.InputKinds = *(*uint32)(unsafe.Pointer(&b[28]))
+	x.InputRate = *(*float32)(unsafe.Pointer(&b[32]))
+	x.YAxisUp = b[36] != 0
+	return nil
+}
+
+// QualityScore rates a session from 0 (unusable) to 100 (perfect), for dashboards and adaptation triggers.
+// It is a weighted sum of the following components, each scaled linearly between a perfect and an unusable bound:
+//
+//	loss rate (0 to 1)     35%, from 0 to 5%
+//	latency                25%, from 50ms to 300ms
+//	jitter                 15%, from 0 to 50ms
+//	deliveredFps/targetFps 25%, from 1 to 0; a non positive targetFps counts as perfect
+//
+// NaN inputs score their component as unusable.
+func QualityScore(lossRate float64, jitter, latency time.Duration, deliveredFps, targetFps float32) int {
+	loss := 1 - lossRate/0.05
+	lat := 1 - float64(latency-50*time.Millisecond)/float64(250*time.Millisecond)
+	jit := 1 - float64(jitter)/float64(50*time.Millisecond)
+	fps := 1.0
+	if targetFps > 0 || targetFps != targetFps {
+		fps = float64(deliveredFps / targetFps)
+	}
+
+	score := 35*clampUnit(loss) + 25*clampUnit(lat) + 15*clampUnit(jit) + 25*clampUnit(fps)
+	return int(math.Round(score))
+}
+
+// QualityTier buckets sessions for capacity planning and reporting.
+type QualityTier byte
+
+// QuantizeFps returns the highest supported rate not exceeding requested, so that both ends agree on the effective rate.
+// If all supported rates exceed the request, the lowest one is returned. If supported is empty, requested is returned unchanged.
+func QuantizeFps(requested float32, supported []float32) float32 {
+	if len(supported) == 0 {
+		return requested
+	}
+
+	best, lowest := float32(-1), supported[0]
+	for _, fps := range supported {
+		if fps <= requested && fps > best {
+			best = fps
+		}
+		if fps < lowest {
+			lowest = fps
+		}
+	}
+
+	if best < 0 {
+		return lowest
+	}
+	return best
+}
+
+// RecommendBufferDelay returns a jitter buffer depth for the measured jitter and loss rate (0 to 1).
+// Without loss it is twice the jitter, which hides most reordering. Loss raises it, up to four times the jitter at 10% loss or more,
+// as packets arriving late become more likely; beyond that, a deeper buffer only adds latency.
+func RecommendBufferDelay(jitter time.Duration, lossRate float64) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	if lossRate < 0 {
+		lossRate = 0
+	}
+	if lossRate > 0.1 {
+		lossRate = 0.1
+	}
+	return time.Duration(float64(jitter) * (2 + 20*lossRate))
+}
+
+// RecommendKeyframeInterval shortens the base keyframe interval as the loss rate (0 to 1) rises, to aid recovery.
+// At 5% loss the interval is halved. The result never drops below an eighth of the base interval.
+func RecommendKeyframeInterval(loss float64, baseInterval time.Duration) time.Duration {
+	if loss <= 0 {
+		return baseInterval
+	}
+	if loss > 1 {
+		loss = 1
+	}
+
+	interval := time.Duration(float64(baseInterval) / (1 + 20*loss))
+	if floor := baseInterval / 8; interval < floor {
+		return floor
+	}
+	return interval
+}
+
+// ReleaseAllKeys returns a payload with a key up event for each held key, for the engine to apply on session teardown, so the next session doesn't inherit stuck keys.
+func ReleaseAllKeys(held []string, ts time.Duration) InputPayload {
+	x := MakeInputPayload()
+	x.TsSet(ts)
+	for _, key := range held {
+		x = x.AppendKeyUp(key)
+	}
+	return x
+}
+
+// ResumePayload is used to resume an interrupted session without a fresh handshake.
+// The client sends a PacketResumeRequest holding its resume token and the last sequence number it received.
+// The engine replies with either a PacketResumeAccept, holding the sequence number it will resume from and no token, or a PacketResumeReject.
+//
+// Packets carry no sequence field. Instead, both ends count the engine to client packets of the session, starting at 1.
+// The engine counts in send order and the client in receive order, which match over an ordered transport. Resume packets are not counted.
+// On accept, the returned number is the count of the next packet the engine sends. Packets between the client's number and it are not resent.
+type ResumePayload []byte
+
+func MakeResumePayload(token []byte, seq uint64) ResumePayload {
+	x := make(ResumePayload, 8+len(token))
+	x.SeqSet(seq)
+	copy(x[8:], token)
+	return x
+}
+
+func (x ResumePayload) Seq() uint64 {
+	return *(*uint64)(unsafe.Pointer(&x[0]))
+}
+
+func (x ResumePayload) SeqSet(seq uint64) {
+	b := *(*[8]byte)(unsafe.Pointer(&seq))
+	copy(x, b[:])
+}
+
+func (x ResumePayload) Token() []byte {
+	return x[8:]
+}
+
+// ScrollUnit specifies how scroll deltas should be scaled by the receiver.
+// The plain InputScroll event is always measured in ScrollPixel.
+type ScrollUnit byte
+
+// Secondary defines secondary client setup parameters for the rendering engine.
+type Secondary struct {
+	Id           uint64
+	WebcamWidth  int32
+	WebcamHeight int32
+	WebcamMaxFps float32 // 0 means uncapped; adjusted at runtime through InputWebcamFps
 }
 
-type InputKind byte
+// WebcamPacketSize returns the size of a packet holding a single webcam frame from this secondary.
+// Webcam frames use the same payload layout as render frames.
+// Returns 0 if the webcam has no area.
+func (x Secondary) WebcamPacketSize() int {
+	n := VideoPayloadSize(int(x.WebcamWidth), int(x.WebcamHeight))
+	if n == 0 {
+		return 0
+	}
+	return PacketHeaderSize + n
+}
 
-type InputPayload []byte
+// SessionBudget enforces a total byte rate per client session, across all packet kinds.
+type SessionBudget struct {
+	limit float64 // bytes per second
+	rates *BandwidthByKind
+}
 
-func MakeInputPayload() InputPayload {
-	return make(InputPayload, 8)
+// NewSessionBudget returns a budget of limit bytes per second per client, measured over window.
+func NewSessionBudget(limit float64, window time.Duration) *SessionBudget {
+	return &SessionBudget{
+		limit: limit,
+		rates: NewBandwidthByKind(window),
+	}
 }
 
-func (x InputPayload) AppendKeyDown(key string) InputPayload {
-	return x.appendKey(InputKeyDown, key)
+// Observe must be called with every packet sent to or received from a client.
+func (x *SessionBudget) Observe(p Packet) {
+	x.rates.Observe(p)
 }
 
-func (x InputPayload) AppendKeyUp(key string) InputPayload {
-	return x.appendKey(InputKeyUp, key)
+// Rate returns the total byte rate of a client.
+func (x *SessionBudget) Rate(id uint64) float64 {
+	var total float64
+	for _, rate := range x.rates.Rates(id) {
+		total += rate
+	}
+	return total
 }
 
-func (x InputPayload) AppendScroll(delta int8) InputPayload {
-	return append(x, byte(InputScroll), byte(delta))
+func (x *SessionBudget) Remove(id uint64) {
+	x.rates.Remove(id)
 }
 
-func (x InputPayload) AppendVector(xPos, yPos uint16) InputPayload {
-	b := *(*[2]byte)(unsafe.Pointer(&xPos))
-	x = append(x, byte(InputVector), b[0], b[1])
+// Shed returns the packet kind that should be dropped for a client that is over budget, being the droppable kind using the most bandwidth.
+// Returns false if the client is within budget, or none of its traffic is droppable.
+func (x *SessionBudget) Shed(id uint64) (PacketKind, bool) {
+	rates := x.rates.Rates(id)
 
-	b = *(*[2]byte)(unsafe.Pointer(&yPos))
-	return append(x, b[0], b[1])
-}
+	var total float64
+	for _, rate := range rates {
+		total += rate
+	}
+	if total <= x.limit {
+		return 0, false
+	}
 
-func (x InputPayload) Data() []byte {
-	return x[8:]
+	var kind PacketKind
+	var top float64
+	for k, rate := range rates {
+		if k.Droppable() && (rate > top || rate == top && k < kind) {
+			kind, top = k, rate
+		}
+	}
+	return kind, top > 0
 }
 
-func (x InputPayload) IsEmpty() bool {
-	if len(x) == 8 {
-		return true
-	}
-	return false
+// Within reports whether a client is within budget.
+func (x *SessionBudget) Within(id uint64) bool {
+	return x.Rate(id) <= x.limit
 }
 
-// Reset can be used to compose a new InputPayload, without reallocation.
-func (x InputPayload) Reset() InputPayload {
-	return x[:8]
+// StallDetector detects a client stream that stopped receiving packets, faster than a transport timeout would.
+// It is safe for concurrent use.
+type StallDetector struct {
+	last int64 // time.Duration
 }
 
-func (x InputPayload) Ts() time.Duration {
-	return *(*time.Duration)(unsafe.Pointer(&x[0])) // int64
+// NewStallDetector returns a detector touched at creation.
+func NewStallDetector() *StallDetector {
+	x := &StallDetector{}
+	x.Touch()
+	return x
 }
 
-func (x InputPayload) TsSet(ts time.Duration) {
-	b := *(*[8]byte)(unsafe.Pointer(&ts))
-	copy(x, b[:])
+// IsStalled reports whether no packet has been received for longer than threshold, as of now.
+// now must be obtained from Now, the clock used by Touch, rather than from the wall clock or packet timestamps.
+func (x *StallDetector) IsStalled(now, threshold time.Duration) bool {
+	return now-time.Duration(atomic.LoadInt64(&x.last)) > threshold
 }
 
-func (x InputPayload) appendKey(kind InputKind, key string) InputPayload {
-	x = append(x, byte(kind))
-	x = append(x, byte(len(key)))
-	x = append(x, key...)
-	return x
+// Touch must be called on every received packet.
+func (x *StallDetector) Touch() {
+	atomic.StoreInt64(&x.last, int64(Now()))
 }
 
-type Packet []byte
+// SyncAnchorPayload asserts that an audio Pts and a video Pts refer to the same instant.
+// It is needed when audio and video are captured on different clocks; the client aligns its audio timeline to its video timeline using the anchors.
+type SyncAnchorPayload []byte
 
-func MakePacket(payloadSize int) Packet {
-	x := make(Packet, 17+payloadSize)
-	x.SizeSet(payloadSize)
+func MakeSyncAnchorPayload(audio, video time.Duration) SyncAnchorPayload {
+	x := make(SyncAnchorPayload, 16)
+	x.AudioAnchorSet(audio)
+	x.VideoAnchorSet(video)
 	return x
 }
 
-func (x Packet) Id() uint64 {
-	return *(*uint64)(unsafe.Pointer(&x[0]))
+func (x SyncAnchorPayload) AudioAnchor() time.Duration {
+	return *(*time.Duration)(unsafe.Pointer(&x[0]))
 }
 
-func (x Packet) IdSet(id uint64) {
-	b := *(*[8]byte)(unsafe.Pointer(&id))
+func (x SyncAnchorPayload) AudioAnchorSet(t time.Duration) {
+	b := *(*[8]byte)(unsafe.Pointer(&t))
 	copy(x, b[:])
 }
 
-func (x Packet) Kind() PacketKind {
-	return PacketKind(x[8])
-}
-
-func (x Packet) KindSet(kind PacketKind) {
-	x[8] = byte(kind)
+func (x SyncAnchorPayload) Bytes() []byte {
+	return x
 }
 
-func (x Packet) Payload() []byte {
-	return x[17:]
+func (x SyncAnchorPayload) Kind() PacketKind {
+	return PacketSyncAnchor
 }
 
-// PayloadSet copies b into the packet, reallocating it if the copy doesn't fit.
-func (x Packet) PayloadSet(b []byte) {
-	x = append(x[:17], b...)
-	x.SizeSet(len(b))
+// Ts is the same as VideoAnchor.
+func (x SyncAnchorPayload) Ts() time.Duration {
+	return x.VideoAnchor()
 }
 
-// Size returns the payload size.
-func (x Packet) Size() int {
-	return int(*(*uint64)(unsafe.Pointer(&x[9])))
+func (x SyncAnchorPayload) VideoAnchor() time.Duration {
+	return *(*time.Duration)(unsafe.Pointer(&x[8]))
 }
 
-func (x Packet) SizeSet(size int) {
-	// store as uint64 for portability
-	sz := uint64(size)
-	b := *(*[8]byte)(unsafe.Pointer(&sz))
-	copy(x[9:], b[:])
+func (x SyncAnchorPayload) VideoAnchorSet(t time.Duration) {
+	b := *(*[8]byte)(unsafe.Pointer(&t))
+	copy(x[8:], b[:])
 }
 
-type PacketKind byte
+// TestPatternVideoPayload returns a frame of color bars, scrolling horizontally with the frame index.
+// The output is deterministic. Pts and Duration assume 60 frames per second.
+// Returns nil under the same conditions as MakeVideoPayload.
+func TestPatternVideoPayload(width, height int, format PixelFormat, frame int) VideoPayload {
+	const fps = 60
 
-// Primary defines primary client setup parameters for the rendering engine.
-type Primary struct {
-	Id           uint64
-	RenderWidth  int32
-	RenderHeight int32
-	WebcamWidth  int32
-	WebcamHeight int32
-	MaxFps       float32
-}
+	x := MakeVideoPayload(width, height, format)
+	if x == nil {
+		return nil
+	}
+	x.PtsSet(time.Duration(frame) * time.Second / fps)
+	x.DurationSet(time.Second / fps)
 
-func (x Primary) AsSecondary() Secondary {
-	return Secondary{
-		Id:           x.Id,
-		WebcamWidth:  x.WebcamWidth,
-		WebcamHeight: x.WebcamHeight,
+	bars := [8][3]byte{
+		{255, 255, 255},
+		{255, 255, 0},
+		{0, 255, 255},
+		{0, 255, 0},
+		{255, 0, 255},
+		{255, 0, 0},
+		{0, 0, 255},
+		{0, 0, 0},
+	}
+	color := func(i int) [3]byte {
+		pos := ((i+4*frame)%width + width) % width // frame may be negative
+		return bars[pos*8/width]
 	}
-}
 
-// Secondary defines secondary client setup parameters for the rendering engine.
-type Secondary struct {
-	Id           uint64
-	WebcamWidth  int32
-	WebcamHeight int32
+	data := x.Data()
+	switch format {
+	case PixelRGBA:
+		for i := 0; i < height; i++ {
+			for j := 0; j < width; j++ {
+				c := color(j)
+				k := 4 * (i*width + j)
+				data[k], data[k+1], data[k+2], data[k+3] = c[0], c[1], c[2], 255
+			}
+		}
+	case PixelNV12:
+		for i := 0; i < height; i++ {
+			for j := 0; j < width; j++ {
+				data[i*width+j], _, _ = rgbToYuv(color(j))
+			}
+		}
+		uv := data[width*height:]
+		stride := 2 * ((width + 1) / 2)
+		for i := 0; i < (height+1)/2; i++ {
+			for j := 0; j < (width+1)/2; j++ {
+				_, u, v := rgbToYuv(color(2 * j))
+				uv[i*stride+2*j], uv[i*stride+2*j+1] = u, v
+			}
+		}
+	}
+	return x
 }
 
 // TmpBuffer is used by websockets to receive RPC messages.
@@ -187,10 +2777,195 @@ func (x *TmpBuffer) WriteTo(w io.Writer) error {
 	return err
 }
 
+// ToMillis converts a timestamp to milliseconds, as expected by C#. Truncates sub-millisecond precision.
+func ToMillis(t time.Duration) int64 {
+	return t.Milliseconds()
+}
+
+// VideoApplyDiff reconstructs a frame from the previous one and the output of VideoDiff. prev is not modified.
+// Returns ErrVideoDiffMalformed if the frame described by the diff header doesn't have the size of prev.
+func VideoApplyDiff(prev VideoPayload, diff []byte) (VideoPayload, error) {
+	if len(diff) < videoHeaderSize || len(prev) < videoHeaderSize {
+		return nil, ErrVideoDiffMalformed
+	}
+
+	x := make(VideoPayload, len(prev))
+	copy(x, diff[:videoHeaderSize])
+	data := x.Data()
+	if n := x.Format().FrameSize(x.Width(), x.Height()); n == 0 || n != len(data) {
+		return nil, ErrVideoDiffMalformed
+	}
+	copy(data, prev.Data())
+
+	var pos uint64
+	for b := diff[videoHeaderSize:]; len(b) > 0; {
+		skip, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, ErrVideoDiffMalformed
+		}
+		b = b[n:]
+
+		length, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, ErrVideoDiffMalformed
+		}
+		b = b[n:]
+
+		pos += skip
+		if length > uint64(len(b)) || pos+length > uint64(len(data)) {
+			return nil, ErrVideoDiffMalformed
+		}
+		copy(data[pos:], b[:length])
+		b = b[length:]
+		pos += length
+	}
+	return x, nil
+}
+
+// VideoDiff encodes the changes from prev to cur, for content where most pixels stay the same.
+// Returns nil if the frames differ in size or are shorter than a header, in which case cur must be sent in full.
+//
+// The diff consists of the header of cur, followed by runs of changed bytes.
+// Each run is encoded as uvarints holding the number of unchanged bytes skipped since the previous run and the run length, followed by the changed bytes.
+func VideoDiff(prev, cur VideoPayload) []byte {
+	if len(prev) != len(cur) || len(cur) < videoHeaderSize {
+		return nil
+	}
+
+	const minGap = 8 // unchanged bytes shorter than this are included in the run, as they would cost about as much to encode
+
+	o := append([]byte{}, cur[:videoHeaderSize]...)
+	a, b := prev.Data(), cur.Data()
+	var last int // end of the previous run
+	for i := 0; i < len(b); {
+		if a[i] == b[i] {
+			i++
+			continue
+		}
+
+		start := i
+		for gap := 0; i < len(b) && gap < minGap; i++ {
+			if a[i] == b[i] {
+				gap++
+			} else {
+				gap = 0
+			}
+		}
+		end := i
+		for end > start && a[end-1] == b[end-1] {
+			end--
+		}
+
+		o = appendUvarint(o, uint64(start-last))
+		o = appendUvarint(o, uint64(end-start))
+		o = append(o, b[start:end]...)
+		last = end
+	}
+	return o
+}
+
+type VideoFlags byte
+
+// VideoPayload holds a single uncompressed frame. The header is laid out as:
+//
+//	0  Pts
+//	8  Duration
+//	16 width (int32)
+//	20 height (int32)
+//	24 PixelFormat
+//	25 VideoFlags
+//	26 tile row, tile column, grid rows, grid columns
+//	30 encode queue depth
+//	31 reserved
+//	32 render cost
+//	40 pixel data
+//
+// Each frame is self-describing, so it can be saved or decoded without reference to other frames.
+//
+// Tiled frames are split into a grid of independently sent tiles, all sharing the same Pts, which the client assembles into a single canvas.
+// Width and height then refer to the tile. A zero grid means the frame is not tiled.
 type VideoPayload []byte
 
+// MakeVideoPayload returns nil if the frame has no area.
+func MakeVideoPayload(width, height int, format PixelFormat) VideoPayload {
+	n := format.VideoPayloadSize(width, height)
+	if n == 0 {
+		return nil
+	}
+
+	x := make(VideoPayload, n)
+	x.WidthSet(width)
+	x.HeightSet(height)
+	x.FormatSet(format)
+	return x
+}
+
+// MakeVideoPayloadAligned is like MakeVideoPayload, but places the pixel data at an address that is a multiple of align.
+// This helps SIMD processing, at the cost of up to align-1 extra bytes of memory per frame.
+// Also returns nil if align is not a positive power of 2.
+func MakeVideoPayloadAligned(width, height int, format PixelFormat, align int) VideoPayload {
+	if align <= 0 || align&(align-1) != 0 {
+		return nil
+	}
+
+	n := format.VideoPayloadSize(width, height)
+	if n == 0 {
+		return nil
+	}
+
+	b := make([]byte, n+align-1)
+	off := int(-uintptr(unsafe.Pointer(&b[videoHeaderSize])) & uintptr(align-1))
+
+	x := VideoPayload(b[off : off+n : off+n])
+	x.WidthSet(width)
+	x.HeightSet(height)
+	x.FormatSet(format)
+	return x
+}
+
+// ParseVideoPayload validates a received frame, without copying it.
+// The pixel data must match the size, area and format in the header.
+func ParseVideoPayload(b []byte) (VideoPayload, error) {
+	if len(b) < videoHeaderSize {
+		return nil, ErrPayloadTruncated
+	}
+
+	x := VideoPayload(b)
+	if n := x.Format().FrameSize(x.Width(), x.Height()); n == 0 || len(x.Data()) != n {
+		return nil, ErrPayloadTruncated
+	}
+	return x, nil
+}
+
+func (x VideoPayload) Bytes() []byte {
+	return x
+}
+
+// Compact returns a payload sized for newFormat, with the same header, such that oversized buffers can be released after a format downgrade.
+// The pixel data is not converted. Returns x unchanged if the format is the same.
+// Returns nil if the current data size doesn't match the current format, or if newFormat is unknown.
+func (x VideoPayload) Compact(newFormat PixelFormat) VideoPayload {
+	format := x.Format()
+	if len(x.Data()) != format.FrameSize(x.Width(), x.Height()) {
+		return nil
+	}
+	if newFormat == format {
+		return x
+	}
+
+	n := newFormat.VideoPayloadSize(x.Width(), x.Height())
+	if n == 0 {
+		return nil
+	}
+
+	y := make(VideoPayload, n)
+	copy(y, x[:videoHeaderSize])
+	y.FormatSet(newFormat)
+	return y
+}
+
 func (x VideoPayload) Data() []byte {
-	return x[16:]
+	return x[videoHeaderSize:]
 }
 
 func (x VideoPayload) Duration() time.Duration {
@@ -202,6 +2977,105 @@ func (x VideoPayload) DurationSet(t time.Duration) {
 	copy(x[8:], b[:])
 }
 
+// EncodeQueueDepth returns the number of frames that were waiting in the engine's encode queue when this frame was encoded.
+// A growing depth warns the client of engine overload before frames start dropping. 0 if not reported.
+func (x VideoPayload) EncodeQueueDepth() uint8 {
+	return x[30]
+}
+
+func (x VideoPayload) EncodeQueueDepthSet(depth uint8) {
+	x[30] = depth
+}
+
+// EncodePNG writes the frame as a PNG image, in a single call. NV12 frames are converted to RGBA first.
+func (x VideoPayload) EncodePNG(w io.Writer) error {
+	width, height := x.Width(), x.Height()
+	data := x.Data()
+	if len(data) != x.Format().FrameSize(width, height) {
+		return ErrPixelFormat
+	}
+
+	img := &image.NRGBA{
+		Stride: 4 * width,
+		Rect:   image.Rect(0, 0, width, height),
+	}
+	switch x.Format() {
+	case PixelRGBA:
+		img.Pix = data
+	case PixelNV12:
+		img.Pix = make([]byte, 4*width*height)
+		uv := data[width*height:]
+		stride := 2 * ((width + 1) / 2)
+		for i := 0; i < height; i++ {
+			for j := 0; j < width; j++ {
+				k := i/2*stride + j/2*2
+				r, g, b := yuvToRgb(data[i*width+j], uv[k], uv[k+1])
+				p := img.Pix[4*(i*width+j):]
+				p[0], p[1], p[2], p[3] = r, g, b, 255
+			}
+		}
+	default:
+		return ErrPixelFormat
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	return w.Write(buf.Bytes())
+}
+
+func (x VideoPayload) Flags() VideoFlags {
+	return VideoFlags(x[25])
+}
+
+// FlagsSet also sets VideoKeyframe if VideoResolutionChange is set, as resolution switches must coincide with a keyframe for a clean decode.
+func (x VideoPayload) FlagsSet(flags VideoFlags) {
+	if flags&VideoResolutionChange != 0 {
+		flags |= VideoKeyframe
+	}
+	x[25] = byte(flags)
+}
+
+func (x VideoPayload) Format() PixelFormat {
+	return PixelFormat(x[24])
+}
+
+func (x VideoPayload) FormatSet(format PixelFormat) {
+	x[24] = byte(format)
+}
+
+// Grid returns the tile grid dimensions of the frame.
+func (x VideoPayload) Grid() (rows, cols uint8) {
+	return x[28], x[29]
+}
+
+func (x VideoPayload) GridSet(rows, cols uint8) {
+	x[28], x[29] = rows, cols
+}
+
+func (x VideoPayload) Height() int {
+	return int(*(*int32)(unsafe.Pointer(&x[20])))
+}
+
+func (x VideoPayload) HeightSet(height int) {
+	putInt32(x[20:], height)
+}
+
+// Kind always returns PacketVideo. Lossless frames must have their packet kind changed to PacketVideoLossless.
+func (x VideoPayload) Kind() PacketKind {
+	return PacketVideo
+}
+
+// LatencyBreakdown splits the latency of this frame, given the times at which it was sent, received and displayed.
+// All timestamps must share the same clock.
+func (x VideoPayload) LatencyBreakdown(sentTs, recvTs, displayTs time.Duration) LatencyParts {
+	return LatencyParts{
+		Network:   recvTs - sentTs,
+		Buffering: displayTs - recvTs,
+	}
+}
+
 func (x VideoPayload) Pts() time.Duration {
 	return *(*time.Duration)(unsafe.Pointer(&x[0])) // int64
 }
@@ -211,6 +3085,193 @@ func (x VideoPayload) PtsSet(t time.Duration) {
 	copy(x, b[:])
 }
 
+// RenderCost returns the time the engine spent rendering and encoding this frame, or 0 if it wasn't measured.
+func (x VideoPayload) RenderCost() time.Duration {
+	return *(*time.Duration)(unsafe.Pointer(&x[32]))
+}
+
+func (x VideoPayload) RenderCostSet(t time.Duration) {
+	b := *(*[8]byte)(unsafe.Pointer(&t))
+	copy(x[32:], b[:])
+}
+
+// Tile returns the position of this tile within the grid.
+func (x VideoPayload) Tile() (row, col uint8) {
+	return x[26], x[27]
+}
+
+func (x VideoPayload) TileSet(row, col uint8) {
+	x[26], x[27] = row, col
+}
+
+// Ts is the same as Pts.
+func (x VideoPayload) Ts() time.Duration {
+	return x.Pts()
+}
+
+func (x VideoPayload) Width() int {
+	return int(*(*int32)(unsafe.Pointer(&x[16])))
+}
+
+func (x VideoPayload) WidthSet(width int) {
+	putInt32(x[16:], width)
+}
+
+// VideoPayloadSize returns the size of an RGBA payload.
+// Returns 0 if either dimension is not positive, as such frames are invalid.
 func VideoPayloadSize(width, height int) int {
-	return 16 + 4*width*height
+	return PixelRGBA.VideoPayloadSize(width, height)
+}
+
+// VideoRectPayload replaces the pixels of a region of the current frame, as a cheaper alternative to a full keyframe.
+// The header is laid out as:
+//
+//	0  Pts
+//	8  x (int32)
+//	12 y (int32)
+//	16 width (int32)
+//	20 height (int32)
+//	24 PixelFormat, which must match the frame
+//	25 reserved, up to offset 32
+//
+// followed by the pixel data. See Framebuffer.
+type VideoRectPayload []byte
+
+// MakeVideoRectPayload returns nil if the rectangle has no area.
+func MakeVideoRectPayload(xPos, yPos, width, height int, format PixelFormat) VideoRectPayload {
+	n := format.FrameSize(width, height)
+	if n == 0 {
+		return nil
+	}
+
+	x := make(VideoRectPayload, videoRectHeaderSize+n)
+	x.XSet(xPos)
+	x.YSet(yPos)
+	putInt32(x[16:], width)
+	putInt32(x[20:], height)
+	x[24] = byte(format)
+	return x
+}
+
+// ParseVideoRectPayload validates a received rectangle, without copying it.
+func ParseVideoRectPayload(b []byte) (VideoRectPayload, error) {
+	if len(b) < videoRectHeaderSize {
+		return nil, ErrPayloadTruncated
+	}
+
+	x := VideoRectPayload(b)
+	if n := x.Format().FrameSize(x.Width(), x.Height()); n == 0 || len(x.Data()) != n {
+		return nil, ErrPayloadTruncated
+	}
+	return x, nil
+}
+
+func (x VideoRectPayload) Bytes() []byte {
+	return x
+}
+
+func (x VideoRectPayload) Data() []byte {
+	return x[videoRectHeaderSize:]
+}
+
+func (x VideoRectPayload) Format() PixelFormat {
+	return PixelFormat(x[24])
+}
+
+func (x VideoRectPayload) Height() int {
+	return int(*(*int32)(unsafe.Pointer(&x[20])))
+}
+
+func (x VideoRectPayload) Kind() PacketKind {
+	return PacketVideoRect
+}
+
+func (x VideoRectPayload) Pts() time.Duration {
+	return *(*time.Duration)(unsafe.Pointer(&x[0])) // int64
+}
+
+func (x VideoRectPayload) PtsSet(t time.Duration) {
+	b := *(*[8]byte)(unsafe.Pointer(&t))
+	copy(x, b[:])
+}
+
+// Ts is the same as Pts.
+func (x VideoRectPayload) Ts() time.Duration {
+	return x.Pts()
+}
+
+func (x VideoRectPayload) Width() int {
+	return int(*(*int32)(unsafe.Pointer(&x[16])))
+}
+
+func (x VideoRectPayload) X() int {
+	return int(*(*int32)(unsafe.Pointer(&x[8])))
+}
+
+func (x VideoRectPayload) XSet(xPos int) {
+	putInt32(x[8:], xPos)
+}
+
+func (x VideoRectPayload) Y() int {
+	return int(*(*int32)(unsafe.Pointer(&x[12])))
+}
+
+func (x VideoRectPayload) YSet(yPos int) {
+	putInt32(x[12:], yPos)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// putInt32 stores v at the start of b, as an int32.
+func putInt32(b []byte, v int) {
+	v32 := int32(v)
+	src := *(*[4]byte)(unsafe.Pointer(&v32))
+	copy(b, src[:])
+}
+
+// rgbToYuv converts using BT.601 limited range coefficients.
+func rgbToYuv(c [3]byte) (y, u, v byte) {
+	r, g, b := int(c[0]), int(c[1]), int(c[2])
+	y = byte((66*r+129*g+25*b+128)>>8 + 16)
+	u = byte((-38*r-74*g+112*b+128)>>8 + 128)
+	v = byte((112*r-94*g-18*b+128)>>8 + 128)
+	return
+}
+
+func saturateInt16(v float64) int16 {
+	if v >= math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v <= math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(math.Round(v))
+}
+
+// validateWith adapts a Parse function for use in payloadValidators.
+func validateWith[T any](parse func([]byte) (T, error)) func([]byte) error {
+	return func(b []byte) error {
+		_, err := parse(b)
+		return err
+	}
+}
+
+// yuvToRgb is the inverse of rgbToYuv.
+func yuvToRgb(y, u, v byte) (r, g, b byte) {
+	c, d, e := 298*(int(y)-16), int(u)-128, int(v)-128
+	clamp := func(n int) byte {
+		n = (n + 128) >> 8
+		if n < 0 {
+			return 0
+		}
+		if n > 255 {
+			return 255
+		}
+		return byte(n)
+	}
+	return clamp(c + 409*e), clamp(c - 100*d - 208*e), clamp(c + 516*d)
 }
@@ -0,0 +1,714 @@
+package cross
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/blitz-frost/io"
+)
+
+func TestRecoverFEC(t *testing.T) {
+	group := []Packet{
+		PacketFrom(1, MakeInputPayload().AppendKeyDown("a")),
+		PacketFrom(1, MakeInputPayload().AppendVector(1, 2).AppendScroll(-3)),
+		PacketFrom(1, MakeInputPayload()),
+	}
+	parity := MakeFEC(group)
+
+	for missing := range group {
+		var received []Packet
+		for i, p := range group {
+			if i != missing {
+				received = append(received, p)
+			}
+		}
+
+		p, ok := RecoverFEC(received, parity)
+		if !ok {
+			t.Fatalf("missing %d: not recovered", missing)
+		}
+		if !bytes.Equal(p, group[missing]) {
+			t.Fatalf("missing %d: got %v, want %v", missing, p, group[missing])
+		}
+	}
+
+	// relays decrement the TTL of each packet independently
+	hop := append(Packet{}, parity...)
+	hop.DecTTL()
+	received := []Packet{append(Packet{}, group[0]...), group[2]}
+	received[0].TTLSet(3)
+	p, ok := RecoverFEC(received, hop)
+	if !ok {
+		t.Fatal("not recovered after a relay hop")
+	}
+	if p.TTL() != hop.TTL() {
+		t.Fatalf("recovered TTL %d, want %d", p.TTL(), hop.TTL())
+	}
+	want := append(Packet{}, group[1]...)
+	want.TTLSet(hop.TTL())
+	if !bytes.Equal(p, want) {
+		t.Fatal("recovered packet differs beyond its TTL")
+	}
+
+	if _, ok := RecoverFEC(group[1:], group[0]); ok {
+		t.Fatal("recovered from a non-FEC packet")
+	}
+	if _, ok := RecoverFEC(group[1:], parity[:PacketHeaderSize+8]); ok {
+		t.Fatal("recovered from a truncated parity packet")
+	}
+	if _, ok := RecoverFEC(group[:1], parity); ok {
+		t.Fatal("recovered with more than one missing packet")
+	}
+
+	long := append(Packet{}, group[1]...)
+	long = append(long, make([]byte, len(parity))...)
+	if _, ok := RecoverFEC([]Packet{group[0], long}, parity); ok {
+		t.Fatal("recovered with a packet longer than the parity data")
+	}
+}
+
+func TestFramebuffer(t *testing.T) {
+	var fb Framebuffer
+	rect := MakeVideoRectPayload(1, 1, 2, 1, PixelRGBA)
+	for i := range rect.Data() {
+		rect.Data()[i] = 9
+	}
+	rect.PtsSet(5)
+
+	if err := fb.ApplyRect(rect); err != ErrNoKeyframe {
+		t.Fatalf("rect before keyframe: got %v", err)
+	}
+
+	bad := MakeVideoPayload(4, 4, PixelRGBA)
+	bad.WidthSet(100)
+	bad.HeightSet(100)
+	if err := fb.ApplyKeyframe(bad); err == nil {
+		t.Fatal("accepted a keyframe whose data doesn't match its header")
+	}
+
+	if err := fb.ApplyKeyframe(MakeVideoPayload(4, 3, PixelRGBA)); err != nil {
+		t.Fatal(err)
+	}
+	if err := fb.ApplyRect(rect); err != nil {
+		t.Fatal(err)
+	}
+
+	cur := fb.Current()
+	if cur.Pts() != 5 {
+		t.Fatalf("Pts %v, want 5", cur.Pts())
+	}
+	for i, v := range cur.Data() {
+		var want byte
+		if i >= 4*(4+1) && i < 4*(4+3) {
+			want = 9
+		}
+		if v != want {
+			t.Fatalf("byte %d is %d, want %d", i, v, want)
+		}
+	}
+
+	if err := fb.ApplyRect(MakeVideoRectPayload(3, 0, 2, 1, PixelRGBA)); err != ErrRectBounds {
+		t.Fatalf("out of bounds rect: got %v", err)
+	}
+}
+
+func TestInputPayloadJSON(t *testing.T) {
+	x := MakeInputPayload().AppendKeyDown("a").AppendVectorTo(1, 2, 3).AppendScrollUnit(-1, 2, ScrollLine).AppendFocusLost()
+	b, err := json.Marshal(x)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var y InputPayload
+	if err := json.Unmarshal(b, &y); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(x.Data(), y.Data()) {
+		t.Fatalf("got %v, want %v", y.Data(), x.Data())
+	}
+
+	b, err = json.Marshal(struct{ P InputPayload }{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"P":null}` {
+		t.Fatalf("zero value encoded as %s", b)
+	}
+}
+
+func TestBatchWriter(t *testing.T) {
+	var mux sync.Mutex
+	var writes [][]byte
+	w := io.WriterFunc(func(b []byte) error {
+		mux.Lock()
+		defer mux.Unlock()
+		writes = append(writes, append([]byte{}, b...))
+		return errWrite
+	})
+
+	p := PacketFrom(1, MakeInputPayload())
+	x := NewBatchWriter(w, 2*len(p), 10*time.Millisecond)
+
+	if err := x.Add(p); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond) // delayed flush fails
+
+	if err := x.Add(p); err != errWrite {
+		t.Fatalf("got %v, want the delayed flush error", err)
+	}
+	if err := x.Flush(); err != errWrite {
+		t.Fatalf("got %v, want the flush error", err)
+	}
+
+	mux.Lock()
+	defer mux.Unlock()
+	if len(writes) != 2 || !bytes.Equal(writes[1], p) {
+		t.Fatalf("the packet added after a failed flush was not written: %v", writes)
+	}
+}
+
+var errWrite = errors.New("write failed")
+
+func TestMetaPayload(t *testing.T) {
+	x := MakeMetaPayload("title", []byte("level 1"))
+	p := PacketFrom(1, x)
+
+	y, err := As[MetaPayload](p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if y.Key() != "title" || string(y.Value()) != "level 1" {
+		t.Fatalf("got %q %q", y.Key(), y.Value())
+	}
+
+	p = PacketFrom(1, MetaPayload{50})
+	if _, err := As[MetaPayload](p); err != ErrPayloadTruncated {
+		t.Fatalf("hostile key length: got %v", err)
+	}
+	if _, err := ParseMetaPayload(nil); err != ErrPayloadTruncated {
+		t.Fatalf("empty payload: got %v", err)
+	}
+}
+
+func TestAppendVector(t *testing.T) {
+	for _, v := range []uint16{0, 32767, 32768, 65535} {
+		x := MakeInputPayload().AppendVector(v, 65535-v)
+		events, err := x.Events()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 {
+			t.Fatalf("%d: got %d events", v, len(events))
+		}
+		if e := events[0]; e.Kind != InputVector || e.X != v || e.Y != 65535-v {
+			t.Fatalf("%d: got %+v", v, e)
+		}
+	}
+}
+
+// TestPacketConcurrentRead exercises the supported concurrent use of a Packet, and should pass under -race.
+func TestPacketConcurrentRead(t *testing.T) {
+	p := PacketFrom(7, MakeInputPayload().AppendKeyDown("a"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if p.Id() != 7 || p.Kind() != PacketInput || p.Size() != len(p.Payload()) {
+					t.Error("inconsistent header")
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestVideoDiff(t *testing.T) {
+	prev := MakeVideoPayload(8, 4, PixelRGBA)
+	cur := MakeVideoPayload(8, 4, PixelRGBA)
+	cur.PtsSet(time.Second)
+	copy(cur.Data()[4:], []byte{1, 2, 3, 4})
+	cur.Data()[100] = 5
+
+	diff := VideoDiff(prev, cur)
+	got, err := VideoApplyDiff(prev, diff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, cur) {
+		t.Fatal("applied diff doesn't match the current frame")
+	}
+
+	if VideoDiff(prev[:10], cur[:10]) != nil {
+		t.Fatal("diffed frames shorter than a header")
+	}
+	if _, err := VideoApplyDiff(prev[:10], diff); err != ErrVideoDiffMalformed {
+		t.Fatalf("short previous frame: got %v", err)
+	}
+
+	bigger := append([]byte{}, diff...)
+	VideoPayload(bigger).WidthSet(16)
+	if _, err := VideoApplyDiff(prev, bigger); err != ErrVideoDiffMalformed {
+		t.Fatalf("header not matching the previous frame: got %v", err)
+	}
+}
+
+func TestMakeVideoPayloadAligned(t *testing.T) {
+	for _, align := range []int{1, 16, 64} {
+		x := MakeVideoPayloadAligned(3, 3, PixelRGBA, align)
+		if addr := uintptr(unsafe.Pointer(&x.Data()[0])); addr%uintptr(align) != 0 {
+			t.Fatalf("align %d: data at %#x", align, addr)
+		}
+		if x.Width() != 3 || x.Height() != 3 || len(x.Data()) != PixelRGBA.FrameSize(3, 3) {
+			t.Fatalf("align %d: wrong frame", align)
+		}
+	}
+
+	for _, align := range []int{-8, 0, 3, 24} {
+		if MakeVideoPayloadAligned(3, 3, PixelRGBA, align) != nil {
+			t.Fatalf("align %d: accepted", align)
+		}
+	}
+}
+
+func TestTestPatternVideoPayload(t *testing.T) {
+	for _, format := range []PixelFormat{PixelRGBA, PixelNV12} {
+		for _, frame := range []int{-100, -1, 0, 1, 100} {
+			x := TestPatternVideoPayload(16, 8, format, frame)
+			if !bytes.Equal(x, TestPatternVideoPayload(16, 8, format, frame)) {
+				t.Fatalf("format %d frame %d: not deterministic", format, frame)
+			}
+		}
+	}
+}
+
+func TestClampFps(t *testing.T) {
+	p := Primary{MaxFps: 60}
+	nan := float32(math.NaN())
+	for _, c := range []struct{ in, want float32 }{{30, 30}, {0, 60}, {-1, 60}, {120, 60}, {nan, 60}} {
+		if got := p.ClampFps(c.in); got != c.want {
+			t.Fatalf("ClampFps(%v) = %v, want %v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestStallDetector(t *testing.T) {
+	x := NewStallDetector()
+	if x.IsStalled(Now(), time.Hour) {
+		t.Fatal("stalled right after creation")
+	}
+	if !x.IsStalled(Now()+2*time.Hour, time.Hour) {
+		t.Fatal("not stalled past the threshold")
+	}
+}
+
+func TestAVSyncMonitor(t *testing.T) {
+	x := NewAVSyncMonitor(40*time.Millisecond, 10)
+	for i := 0; i < 20; i++ {
+		pts := time.Duration(i) * time.Second
+		video := pts
+		if i == 5 {
+			video += 200 * time.Millisecond // transient jitter
+		}
+		x.Observe(video, pts)
+	}
+	if _, drift := x.Drift(); drift {
+		t.Fatal("flagged a transient offset")
+	}
+
+	for i := 0; i < 40; i++ {
+		x.Observe(100*time.Millisecond, 0)
+	}
+	if offset, drift := x.Drift(); !drift || offset < 90*time.Millisecond {
+		t.Fatalf("sustained drift not flagged: %v %v", offset, drift)
+	}
+
+	x = NewAVSyncMonitor(40*time.Millisecond, 0)
+	x.Observe(0, 0)
+	if _, drift := x.Drift(); drift {
+		t.Fatal("flagged drift within threshold with zero hold")
+	}
+}
+
+func TestCompactEncoding(t *testing.T) {
+	for _, id := range []uint64{0, 0x81, 300, 1<<64 - 1} {
+		p := PacketFrom(id, MakeInputPayload().AppendKeyDown("a"))
+		p.TTLSet(3)
+
+		b := p.EncodeCompact()
+		if len(b) >= len(p) {
+			t.Fatalf("id %#x: compact size %d, fixed size %d", id, len(b), len(p))
+		}
+
+		got, n, err := DecodeCompact(append(b, 1, 2, 3))
+		if err != nil {
+			t.Fatalf("id %#x: %v", id, err)
+		}
+		if n != len(b) || !bytes.Equal(got, p) {
+			t.Fatalf("id %#x: got %v after %d bytes, want %v after %d", id, got, n, p, len(b))
+		}
+
+		for i := 0; i < len(b); i++ {
+			if _, _, err := DecodeCompact(b[:i]); err == nil {
+				t.Fatalf("id %#x: decoded a packet truncated to %d bytes", id, i)
+			}
+		}
+	}
+}
+
+func TestPrimaryBinary(t *testing.T) {
+	p := Primary{
+		Id:           7,
+		RenderWidth:  1920,
+		RenderHeight: 1080,
+		WebcamWidth:  640,
+		WebcamHeight: 480,
+		MaxFps:       60,
+		YAxisUp:      true,
+		InputKinds:   InputMask(InputKeyDown, InputVector),
+		InputRate:    120,
+	}
+
+	packet := p.ReconfigurePacket()
+	if packet.Kind() != PacketReconfigure || packet.Id() != p.Id {
+		t.Fatalf("kind %d, id %d", packet.Kind(), packet.Id())
+	}
+
+	var q Primary
+	if err := q.UnmarshalBinary(append(packet.Payload(), 0)); err != nil {
+		t.Fatal(err)
+	}
+	if q != p {
+		t.Fatalf("got %+v, want %+v", q, p)
+	}
+
+	if err := q.UnmarshalBinary(packet.Payload()[:10]); err != ErrPayloadTruncated {
+		t.Fatalf("truncated: got %v", err)
+	}
+}
+
+func TestClientDemuxer(t *testing.T) {
+	clock := DefaultClock
+	DefaultClock = frozenClock(0)
+	defer func() { DefaultClock = clock }()
+
+	channels := make(chan (<-chan Packet), 4)
+	x := NewClientDemuxer(20*time.Millisecond, 1, func(id uint64, packets <-chan Packet) {
+		channels <- packets
+	})
+
+	video := PacketFrom(1, MakeVideoPayload(2, 2, PixelRGBA))
+	if !x.Feed(video) {
+		t.Fatal("first video packet dropped")
+	}
+	if x.Feed(video) {
+		t.Fatal("video packet not dropped with a full channel")
+	}
+	ch := <-channels
+
+	input := PacketFrom(1, MakeInputPayload().AppendKeyDown("a"))
+	done := make(chan bool)
+	go func() { done <- x.Feed(input) }()
+	select {
+	case <-done:
+		t.Fatal("input packet not blocked by a full channel")
+	case <-time.After(5 * time.Millisecond):
+	}
+
+	if p := <-ch; !bytes.Equal(p, video) {
+		t.Fatal("first packet is not the video packet")
+	}
+	if !<-done {
+		t.Fatal("input packet dropped")
+	}
+	if p := <-ch; !bytes.Equal(p, input) {
+		t.Fatal("second packet is not the input packet")
+	}
+
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatal("unexpected packet")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel not closed after the idle timeout, with a frozen DefaultClock")
+	}
+	x.Close()
+}
+
+type frozenClock time.Duration
+
+func (x frozenClock) Now() time.Duration {
+	return time.Duration(x)
+}
+
+func TestCoalesce(t *testing.T) {
+	x := MakeInputPayload().
+		AppendVector(1, 1).
+		AppendVector(2, 2).
+		AppendKeyDown("a").
+		AppendVector(3, 3).
+		AppendVector(4, 4).
+		AppendVectorTo(1, 5, 5).
+		AppendVectorTo(1, 6, 6).
+		AppendVectorTo(2, 7, 7)
+
+	events, err := x.Coalesce().Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []InputEvent{
+		{Kind: InputVector, X: 2, Y: 2},
+		{Kind: InputKeyDown, Key: "a"},
+		{Kind: InputVector, X: 4, Y: 4},
+		{Kind: InputVectorTo, Target: 1, X: 6, Y: 6},
+		{Kind: InputVectorTo, Target: 2, X: 7, Y: 7},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %+v, want %+v", events, want)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Fatalf("event %d: got %+v, want %+v", i, events[i], want[i])
+		}
+	}
+}
+
+func TestAsValidation(t *testing.T) {
+	video := MakeVideoPayload(4, 4, PixelRGBA)
+	if _, err := As[VideoPayload](PacketFrom(1, video)); err != nil {
+		t.Fatal(err)
+	}
+	video.WidthSet(100)
+	if _, err := As[VideoPayload](PacketFrom(1, video)); err != ErrPayloadTruncated {
+		t.Fatalf("video header not matching its data: got %v", err)
+	}
+
+	input := MakeInputPayload().AppendKeyDown("a")
+	if _, err := As[InputPayload](PacketFrom(1, input[:len(input)-1])); err != ErrInputMalformed {
+		t.Fatalf("truncated input: got %v", err)
+	}
+	if _, err := As[InputPayload](PacketFrom(1, make(InputPayload, MaxInputPayloadSize+1))); err != ErrInputTooLarge {
+		t.Fatalf("oversized input: got %v", err)
+	}
+
+	overlay := MakeOverlayPayload(0, 0, 2, 2)
+	if _, err := As[OverlayPayload](PacketFrom(1, overlay[:len(overlay)-1])); err != ErrPayloadTruncated {
+		t.Fatalf("truncated overlay: got %v", err)
+	}
+
+	rect := MakeVideoRectPayload(0, 0, 2, 2, PixelRGBA)
+	if _, err := As[VideoRectPayload](PacketFrom(1, rect[:len(rect)-1])); err != ErrPayloadTruncated {
+		t.Fatalf("truncated rect: got %v", err)
+	}
+
+	batch := MakeAudioBatch(0, 2).Append(time.Millisecond, []int16{1, 2})
+	if _, err := As[AudioBatch](PacketFrom(1, batch)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := As[AudioBatch](PacketFrom(1, batch[:len(batch)-1])); err != ErrPayloadTruncated {
+		t.Fatalf("partial audio chunk: got %v", err)
+	}
+}
+
+func TestAcceptable(t *testing.T) {
+	nan := float32(math.NaN())
+	limits := EngineLimits{MaxRenderWidth: 1920, MaxRenderHeight: 1080, MaxFps: 60}
+	valid := Primary{RenderWidth: 1280, RenderHeight: 720, MaxFps: 30}
+	if err := valid.Acceptable(limits); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []Primary{
+		{RenderWidth: 1280, RenderHeight: 720, MaxFps: nan},
+		{RenderWidth: 1280, RenderHeight: 720, MaxFps: 120},
+		{RenderWidth: 1280, RenderHeight: 720, MaxFps: 30, InputRate: -1},
+		{RenderWidth: 1280, RenderHeight: 720, MaxFps: 30, InputRate: nan},
+		{RenderWidth: 4000, RenderHeight: 720, MaxFps: 30},
+		{RenderWidth: 0, RenderHeight: 720, MaxFps: 30},
+	} {
+		if err := p.Acceptable(limits); !errors.Is(err, ErrLimitExceeded) {
+			t.Fatalf("%+v: got %v", p, err)
+		}
+	}
+}
+
+func TestFrameGate(t *testing.T) {
+	x := NewFrameGate(Primary{})
+	for _, pts := range []time.Duration{10 * time.Millisecond, 5 * time.Millisecond, 5 * time.Millisecond} {
+		if !x.Allow(pts) {
+			t.Fatalf("unlimited gate dropped %v", pts)
+		}
+	}
+
+	x = NewFrameGate(Primary{MaxFps: 60})
+	frame := time.Second / 60
+	for i, c := range []struct {
+		pts  time.Duration
+		want bool
+	}{
+		{10 * time.Second, true},
+		{10*time.Second + frame/2, false},
+		{10*time.Second + frame, true},
+		{0, true}, // restart
+		{frame / 2, false},
+		{time.Second, true},
+		{5 * time.Second, true},
+	} {
+		if got := x.Allow(c.pts); got != c.want {
+			t.Fatalf("%d: Allow(%v) = %v, want %v", i, c.pts, got, c.want)
+		}
+	}
+
+	x.Allow(20 * time.Second)
+	x.Reset()
+	if !x.Allow(20 * time.Second) {
+		t.Fatal("frame dropped after Reset")
+	}
+}
+
+func TestTargetedInput(t *testing.T) {
+	x := MakeInputPayload().
+		AppendKeyDownTo(2, "a").
+		AppendKeyUpTo(2, "a").
+		AppendScrollUnitTo(2, -1, 3, ScrollLine).
+		AppendContextMenuTo(2, 4, 5).
+		AppendVectorTo(2, 6, 7).
+		AppendKeyDown("b")
+
+	want := []InputEvent{
+		{Kind: InputKeyDownTo, Target: 2, Key: "a"},
+		{Kind: InputKeyUpTo, Target: 2, Key: "a"},
+		{Kind: InputScrollUnitTo, Target: 2, DX: -1, DY: 3, Unit: ScrollLine},
+		{Kind: InputContextMenuTo, Target: 2, X: 4, Y: 5},
+		{Kind: InputVectorTo, Target: 2, X: 6, Y: 7},
+		{Kind: InputKeyDown, Key: "b"},
+	}
+	events, err := x.Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %+v, want %+v", events, want)
+	}
+
+	y := MakeInputPayload()
+	for i := range want {
+		if events[i] != want[i] {
+			t.Fatalf("event %d: got %+v, want %+v", i, events[i], want[i])
+		}
+		if y, err = y.AppendEvent(events[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(x, y) {
+		t.Fatal("AppendEvent doesn't reproduce the original encoding")
+	}
+
+	if s, err := x.KeyTranscript(); err != nil || s != "ab" {
+		t.Fatalf("KeyTranscript: got %q, %v", s, err)
+	}
+
+	events, err = x.RemapKeys(map[string]string{"a": "Enter"}).Events()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := events[0]; e.Kind != InputKeyDownTo || e.Target != 2 || e.Key != "Enter" {
+		t.Fatalf("RemapKeys: got %+v", e)
+	}
+}
+
+func TestRecommendBufferDelay(t *testing.T) {
+	jitter := 10 * time.Millisecond
+	for _, c := range []struct {
+		jitter time.Duration
+		loss   float64
+		want   time.Duration
+	}{
+		{0, 0.05, 0},
+		{-jitter, 0.05, 0},
+		{jitter, 0, 20 * time.Millisecond},
+		{jitter, 0.05, 30 * time.Millisecond},
+		{jitter, 0.1, 40 * time.Millisecond},
+		{jitter, 0.5, 40 * time.Millisecond},
+		{jitter, -0.1, 20 * time.Millisecond},
+	} {
+		if got := RecommendBufferDelay(c.jitter, c.loss); got != c.want {
+			t.Errorf("RecommendBufferDelay(%v, %v) = %v, want %v", c.jitter, c.loss, got, c.want)
+		}
+	}
+}
+
+func TestQualityScore(t *testing.T) {
+	ms := time.Millisecond
+	nan := math.NaN()
+	for _, c := range []struct {
+		loss           float64
+		jitter, lat    time.Duration
+		delivered, fps float32
+		want           int
+	}{
+		{0, 0, 20 * ms, 60, 60, 100},
+		{0, 0, 20 * ms, 60, 0, 100},       // no target
+		{0.05, 0, 20 * ms, 60, 60, 65},    // loss only
+		{0, 0, 300 * ms, 60, 60, 75},      // latency only
+		{0, 50 * ms, 20 * ms, 60, 60, 85}, // jitter only
+		{0, 0, 20 * ms, 30, 60, 88},       // half the frames
+		{0.02, 10 * ms, 100 * ms, 50, 60, 74},
+		{1, time.Second, time.Second, 0, 60, 0},
+		{nan, 0, 20 * ms, 60, 60, 65},
+	} {
+		if got := QualityScore(c.loss, c.jitter, c.lat, c.delivered, c.fps); got != c.want {
+			t.Errorf("QualityScore(%v, %v, %v, %v, %v) = %d, want %d", c.loss, c.jitter, c.lat, c.delivered, c.fps, got, c.want)
+		}
+	}
+}
+
+func TestEncryptionPolicy(t *testing.T) {
+	for kind, want := range map[PacketKind]bool{
+		PacketVideo:     false,
+		PacketAudio:     false,
+		PacketInput:     true,
+		PacketMeta:      true,
+		PacketFEC:       true,
+		PacketKind(200): true, // unknown kinds fail closed
+	} {
+		if got := DefaultEncryptionPolicy.Encrypts(kind); got != want {
+			t.Errorf("kind %d: got %v, want %v", kind, got, want)
+		}
+	}
+
+	if !(EncryptionPolicy{}).Encrypts(PacketVideo) {
+		t.Error("empty policy sends video in the clear")
+	}
+}
+
+func TestTier(t *testing.T) {
+	for _, c := range []struct {
+		p    Primary
+		want QualityTier
+	}{
+		{Primary{RenderWidth: 3840, RenderHeight: 2160, MaxFps: 60}, Tier4K},
+		{Primary{RenderWidth: 3840, RenderHeight: 2160, MaxFps: 24}, TierFHD},
+		{Primary{RenderWidth: 3840, RenderHeight: 2160, MaxFps: float32(math.NaN())}, TierFHD},
+		{Primary{RenderWidth: 1280, RenderHeight: 720, MaxFps: 60}, TierHD},
+		{Primary{RenderWidth: 640, RenderHeight: 480, MaxFps: 60}, TierSD},
+		{Primary{RenderWidth: -4000, RenderHeight: -3000, MaxFps: 60}, TierSD},
+		{Primary{RenderWidth: 4000, RenderHeight: 0, MaxFps: 60}, TierSD},
+	} {
+		if got := c.p.Tier(); got != c.want {
+			t.Errorf("%+v: got %d, want %d", c.p, got, c.want)
+		}
+	}
+}
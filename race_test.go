@@ -0,0 +1,35 @@
+//go:build race
+
+package cross
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+)
+
+// TestPacketRaceDetected checks that header access through unsafe is still visible to the race detector.
+// The racy access runs in a child process, as a detected race fails the test it occurs in.
+func TestPacketRaceDetected(t *testing.T) {
+	if os.Getenv("CROSS_RACE_CHILD") == "1" {
+		p := MakePacket(8)
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.SizeSet(4)
+		}()
+		_ = p.Size()
+		wg.Wait()
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestPacketRaceDetected$")
+	cmd.Env = append(os.Environ(), "CROSS_RACE_CHILD=1")
+	out, err := cmd.CombinedOutput()
+	if err == nil || !bytes.Contains(out, []byte("DATA RACE")) {
+		t.Fatalf("concurrent Size and SizeSet not reported:\n%s", out)
+	}
+}